@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/evan-forbes/devnet/config"
+)
+
+const chaosChain = "DEVNET-CHAOS"
+
+// runChaos performs each configured chaos action once its condition is met
+// and its delay has passed. It blocks until every action is performed or
+// reverted, or until ctx is cancelled. Restarted processes aren't waited for,
+// and are stopped with the connections once the run ends.
+func runChaos(ctx context.Context, conf config.Config, manager *SSHManager) {
+	var wg sync.WaitGroup
+	for _, action := range conf.Chaos {
+		wg.Add(1)
+		go func(a config.ChaosAction) {
+			defer wg.Done()
+			err := scheduleChaos(ctx, conf, manager, a)
+			if err != nil {
+				log.Println(fmt.Errorf("failure to perform chaos action %s on %s: %w", a.Action, a.Droplets, err))
+			}
+		}(action)
+	}
+	wg.Wait()
+}
+
+func scheduleChaos(
+	ctx context.Context,
+	conf config.Config,
+	manager *SSHManager,
+	action config.ChaosAction,
+) error {
+	if action.After != nil {
+		err := waitForOutput(ctx, conf.Droplets[action.After.Droplet].Output, action.After.Contains)
+		if err != nil {
+			return err
+		}
+	}
+
+	at, err := action.AtDuration()
+	if err != nil {
+		return err
+	}
+	if err := sleep(ctx, at); err != nil {
+		return err
+	}
+
+	err = performChaos(ctx, conf, manager, action.Action, action)
+	if err != nil {
+		return err
+	}
+
+	revert, err := action.RevertDuration()
+	if err != nil {
+		return err
+	}
+	if revert == 0 {
+		return nil
+	}
+	if err := sleep(ctx, revert); err != nil {
+		return err
+	}
+
+	switch action.Action {
+	case config.ChaosKill:
+		if action.Command == "" {
+			return nil
+		}
+		return performChaos(ctx, conf, manager, config.ChaosRestart, action)
+	case config.ChaosPause:
+		return performChaos(ctx, conf, manager, config.ChaosResume, action)
+	case config.ChaosPartition:
+		return performChaos(ctx, conf, manager, config.ChaosHeal, action)
+	default:
+		return nil
+	}
+}
+
+// performChaos runs the commands for kind on each of the action's droplets,
+// recording an event in each droplet's output. Restarted processes run until
+// they exit or until ctx is cancelled and the connections are closed.
+func performChaos(
+	ctx context.Context,
+	conf config.Config,
+	manager *SSHManager,
+	kind string,
+	action config.ChaosAction,
+) error {
+	ips, err := conf.IPs()
+	if err != nil {
+		return err
+	}
+	bastion, err := conf.BastionIPs()
+	if err != nil {
+		return err
+	}
+
+	isolated := make(map[string]struct{}, len(action.Droplets))
+	for _, name := range action.Droplets {
+		isolated[name] = struct{}{}
+	}
+
+	for _, name := range action.Droplets {
+		if _, skipped := manager.Unreachable[name]; skipped {
+			log.Printf("skipping chaos %s on unreachable droplet %s\n", kind, name)
+			continue
+		}
+		conn, has := manager.Conns[name]
+		if !has {
+			return fmt.Errorf("no connection to droplet %s", name)
+		}
+
+		var commands []string
+		switch kind {
+		case config.ChaosKill:
+			commands = []string{fmt.Sprintf("pkill -KILL -f '%s'", pkillPattern(action.Process))}
+		case config.ChaosRestart:
+			commands = []string{fmt.Sprintf("pkill -KILL -f '%s' || true", pkillPattern(action.Process))}
+		case config.ChaosPause:
+			commands = []string{fmt.Sprintf("pkill -STOP -f '%s'", pkillPattern(action.Process))}
+		case config.ChaosResume:
+			commands = []string{fmt.Sprintf("pkill -CONT -f '%s'", pkillPattern(action.Process))}
+		case config.ChaosPartition:
+			commands = partitionCommands(isolated, ips, bastion)
+		case config.ChaosHeal:
+			commands = []string{fmt.Sprintf("iptables -F %s 2>/dev/null || true", chaosChain)}
+		}
+
+		err := conn.Event("chaos %s %s", kind, describeChaos(action))
+		if err != nil {
+			log.Println(fmt.Errorf("failure to record chaos event for %s: %w", name, err))
+		}
+		fmt.Printf("chaos %s on %s\n", kind, name)
+
+		// partitions need root for iptables, while processes are signaled
+		// as the ssh user
+		run := conn.Run
+		if kind == config.ChaosPartition || kind == config.ChaosHeal {
+			run = conn.RunPrivileged
+		}
+		for _, command := range commands {
+			err := run(command)
+			if err != nil {
+				return fmt.Errorf("failure to run command %s on %s: %w", command, name, err)
+			}
+		}
+
+		if kind == config.ChaosRestart {
+			// the restarted process runs for as long as it did originally,
+			// so don't block the rest of the chaos actions on it
+			go func(n string, c Connection) {
+				err := runCommand(conf, c, action.Command)
+				switch {
+				case err != nil && ctx.Err() != nil:
+					log.Printf("restarted command %s on %s stopped at the end of the run\n", action.Command, n)
+				case err != nil:
+					log.Println(fmt.Errorf("failure to run command %s on %s: %w", action.Command, n, err))
+				}
+			}(name, conn)
+		}
+	}
+
+	return nil
+}
+
+// partitionCommands drops all traffic between the droplet and each droplet
+// that is not part of the isolated set. The traffic with the bastion's IPs is
+// kept, so that the droplets behind it can still be reached to heal the
+// partition.
+func partitionCommands(isolated map[string]struct{}, ips map[string]string, bastion []string) []string {
+	commands := []string{
+		fmt.Sprintf("iptables -N %s 2>/dev/null || true", chaosChain),
+		fmt.Sprintf("iptables -C INPUT -j %[1]s 2>/dev/null || iptables -I INPUT -j %[1]s", chaosChain),
+		fmt.Sprintf("iptables -C OUTPUT -j %[1]s 2>/dev/null || iptables -I OUTPUT -j %[1]s", chaosChain),
+	}
+	for _, ip := range bastion {
+		commands = append(
+			commands,
+			fmt.Sprintf("iptables -A %s -s %s -j RETURN", chaosChain, ip),
+			fmt.Sprintf("iptables -A %s -d %s -j RETURN", chaosChain, ip),
+		)
+	}
+	for other, ip := range ips {
+		if _, has := isolated[other]; has {
+			continue
+		}
+		commands = append(
+			commands,
+			fmt.Sprintf("iptables -A %s -s %s -j DROP", chaosChain, ip),
+			fmt.Sprintf("iptables -A %s -d %s -j DROP", chaosChain, ip),
+		)
+	}
+	return commands
+}
+
+func describeChaos(action config.ChaosAction) string {
+	desc := fmt.Sprintf("droplets=%s", strings.Join(action.Droplets, ","))
+	if action.Process != "" {
+		desc += fmt.Sprintf(" process=%q", action.Process)
+	}
+	return desc
+}
+
+// pkillPattern wraps the first character of the pattern in brackets so that
+// pkill does not match the shell that is running it
+func pkillPattern(pattern string) string {
+	pattern = strings.ReplaceAll(pattern, "'", "")
+	if pattern == "" || !(unicode.IsLetter(rune(pattern[0])) || unicode.IsDigit(rune(pattern[0]))) {
+		return pattern
+	}
+	return fmt.Sprintf("[%c]%s", pattern[0], pattern[1:])
+}
+
+// waitForOutput blocks until the file at path contains text
+func waitForOutput(ctx context.Context, path, text string) error {
+	var (
+		offset int64
+		tail   string
+	)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		data, err := readFrom(path, offset)
+		if err != nil {
+			return err
+		}
+		offset += int64(len(data))
+
+		// keep the end of the previous read in case the text is split
+		// between two reads
+		window := tail + string(data)
+		if strings.Contains(window, text) {
+			return nil
+		}
+		if len(window) > len(text) {
+			tail = window[len(window)-len(text):]
+		} else {
+			tail = window
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func readFrom(path string, offset int64) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(file)
+}
+
+// sleep waits for d, returning early if ctx is cancelled
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
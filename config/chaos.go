@@ -0,0 +1,113 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Chaos actions that can be performed on droplets
+const (
+	// ChaosKill kills the process
+	ChaosKill = "kill"
+	// ChaosRestart kills the process and runs the command to start it again
+	ChaosRestart = "restart"
+	// ChaosPause stops the process using SIGSTOP
+	ChaosPause = "pause"
+	// ChaosResume continues a paused process using SIGCONT
+	ChaosResume = "resume"
+	// ChaosPartition drops all traffic between the droplets and the rest of
+	// the deployment
+	ChaosPartition = "partition"
+	// ChaosHeal removes any partition from the droplets
+	ChaosHeal = "heal"
+)
+
+// ChaosAction describes a fault that is injected into the deployment while
+// the init commands are running
+type ChaosAction struct {
+	// Action: kill || restart || pause || resume || partition || heal
+	Action string `json:"action"`
+	// Droplets are the names of the droplets the action is performed on
+	Droplets []string `json:"droplets"`
+	// Process is the pattern used to find the process by its command line
+	// ie "tendermint node"
+	Process string `json:"process,omitempty"`
+	// Command is the ssh command used to start the process again
+	Command string `json:"command,omitempty"`
+	// At is how long to wait after the init commands start, or after the
+	// condition is met, before performing the action
+	// ie "5m"
+	At string `json:"at,omitempty"`
+	// After is an optional condition that must be met before the action is
+	// performed
+	After *ChaosCondition `json:"after,omitempty"`
+	// Duration optionally reverts the action after some time by restarting a
+	// killed process, resuming a paused process, or healing a partition
+	// ie "30s"
+	Duration string `json:"duration,omitempty"`
+}
+
+// ChaosCondition is met once the output of a droplet contains some text
+type ChaosCondition struct {
+	// Droplet is the name of the droplet whose output is watched
+	Droplet string `json:"droplet"`
+	// Contains is the text that must appear in the droplet's output
+	Contains string `json:"contains"`
+}
+
+// AtDuration returns the parsed At delay
+func (a ChaosAction) AtDuration() (time.Duration, error) {
+	return parseOptionalDuration(a.At)
+}
+
+// RevertDuration returns the parsed Duration
+func (a ChaosAction) RevertDuration() (time.Duration, error) {
+	return parseOptionalDuration(a.Duration)
+}
+
+func (a ChaosAction) ValidateBasic(droplets map[string]Droplet) error {
+	switch a.Action {
+	case ChaosKill, ChaosPause, ChaosResume:
+		if a.Process == "" {
+			return fmt.Errorf("chaos action %s requires a process", a.Action)
+		}
+	case ChaosRestart:
+		if a.Process == "" || a.Command == "" {
+			return fmt.Errorf("chaos action %s requires a process and a command", a.Action)
+		}
+	case ChaosPartition, ChaosHeal:
+	default:
+		return fmt.Errorf("unrecognized chaos action: %s", a.Action)
+	}
+	if len(a.Droplets) == 0 {
+		return fmt.Errorf("chaos action %s has no droplets", a.Action)
+	}
+	for _, name := range a.Droplets {
+		if _, has := droplets[name]; !has {
+			return fmt.Errorf("chaos action %s has a droplet, %s, that is not defined in the Config", a.Action, name)
+		}
+	}
+	if a.After != nil {
+		if _, has := droplets[a.After.Droplet]; !has {
+			return fmt.Errorf("chaos action %s has a condition on a droplet, %s, that is not defined in the Config", a.Action, a.After.Droplet)
+		}
+		if a.After.Contains == "" {
+			return errors.New("chaos condition requires the text to look for")
+		}
+	}
+	if _, err := a.AtDuration(); err != nil {
+		return err
+	}
+	if _, err := a.RevertDuration(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func parseOptionalDuration(d string) (time.Duration, error) {
+	if d == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(d)
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/digitalocean/godo"
 	do "github.com/pulumi/pulumi-digitalocean/sdk/v4/go/digitalocean"
+	"golang.org/x/crypto/ssh"
 )
 
 // Config structures the data used to configure a deployment
@@ -18,8 +19,57 @@ type Config struct {
 	Droplets map[string]Droplet `json:"droplets"`
 	// SSHKeyID is the fingerprint of the ssh key preloaded into digital ocean
 	SSHKeyID string `json:"ssh_key_id"`
+	// SSHKeys are the paths of the private ssh keys tried in order when
+	// connecting to the droplets. ~/.ssh/id_ed25519, ~/.ssh/id_ecdsa and
+	// ~/.ssh/id_rsa are tried if empty.
+	SSHKeys []string `json:"ssh_keys,omitempty"`
+	// SSHUser is the user used to connect to the droplets, defaults to
+	// "root"
+	SSHUser string `json:"ssh_user,omitempty"`
+	// SSHPort is the port used to connect to the droplets, defaults to 22
+	SSHPort int `json:"ssh_port,omitempty"`
+	// Bastion is the jump host used to reach droplets without a public IPv4
+	Bastion *Bastion `json:"bastion,omitempty"`
+	// SSHConfig is the path to an OpenSSH client config, ie "~/.ssh/config",
+	// whose matching Host blocks are used for the settings that aren't set
+	// in this config. It isn't used if empty.
+	SSHConfig string `json:"ssh_config,omitempty"`
+	// KeepAlive configures how dead ssh connections are detected and
+	// re-established
+	KeepAlive *KeepAlive `json:"keep_alive,omitempty"`
+	// DetachCommands runs the init commands in the background of the
+	// droplets, so that they survive a lost ssh connection and their output
+	// is followed again once it is re-established
+	DetachCommands bool `json:"detach_commands,omitempty"`
+	// ConnectConcurrency is the number of droplets connected to at the same
+	// time, defaults to 32
+	ConnectConcurrency int `json:"connect_concurrency,omitempty"`
+	// SkipUnreachable continues with the droplets that could be connected
+	// to instead of failing if some of them are unreachable
+	SkipUnreachable bool `json:"skip_unreachable,omitempty"`
 	// Tag is used to idendify droplets that belong to this deployment
 	Tag string `json:"tag"`
+	// NetemInterface is the network interface shaped by netem, defaults to
+	// "eth0"
+	NetemInterface string `json:"netem_interface,omitempty"`
+	// Chaos are the faults injected while the init commands are running
+	Chaos []ChaosAction `json:"chaos,omitempty"`
+	// RunDir is the directory in which a timestamped directory is created
+	// for the artifacts of each run, defaults to "runs"
+	RunDir string `json:"run_dir,omitempty"`
+	// Metrics configures how the droplets' metrics endpoints are scraped
+	Metrics *Metrics `json:"metrics,omitempty"`
+	// HydraMetrics adds a "hydra" metrics endpoint to each DHT droplet.
+	//
+	// Deprecated: declare the endpoint in the droplets' metrics instead.
+	HydraMetrics *HydraMetrics `json:"hydra_metrics,omitempty"`
+	// Resources configures the sampling of each droplet's cpu, memory and
+	// network usage while the init commands are running
+	Resources *Resources `json:"resources,omitempty"`
+	// KnownHosts is the path to the file in which the host key of each
+	// droplet is recorded on the first connection and verified afterwards,
+	// defaults to "known_hosts_<tag>.json"
+	KnownHosts string `json:"known_hosts,omitempty"`
 }
 
 // Droplet specifies each droplet
@@ -40,7 +90,27 @@ type Droplet struct {
 	Peers []string
 	// Output is the path to output file
 	Output string `json:"output"`
-	Drop   godo.Droplet
+	// Netem emulates the network conditions for all outgoing traffic
+	Netem *Netem `json:"netem,omitempty"`
+	// Links emulates the network conditions for outgoing traffic to specific
+	// droplets, keyed by the name of the other droplet
+	Links map[string]Netem `json:"links,omitempty"`
+	// Forwards are ports on the droplet's localhost that are forwarded to
+	// local ports for the lifetime of a run, in the form
+	// "remotePort[:localPort]"
+	Forwards []string `json:"forwards,omitempty"`
+	// Metrics are the prometheus endpoints scraped while the init commands
+	// are running
+	Metrics []MetricsEndpoint `json:"metrics,omitempty"`
+	// SSHUser overrides the deployment's ssh user for this droplet
+	SSHUser string `json:"ssh_user,omitempty"`
+	// SSHPort overrides the deployment's ssh port for this droplet
+	SSHPort int `json:"ssh_port,omitempty"`
+	// HostKey is the expected host key of the droplet in the authorized_keys
+	// format, ie "ssh-ed25519 AAAA...". The key recorded in the known hosts
+	// file is used if empty.
+	HostKey string `json:"host_key,omitempty"`
+	Drop    godo.Droplet
 }
 
 type NodeType int
@@ -126,7 +196,21 @@ func (c Config) ValidateBasic() error {
 	if len(c.SSHKeyID) == 0 {
 		return errors.New("no ssh key finger print provided")
 	}
+	if err := validPort(c.SSHPort); err != nil {
+		return fmt.Errorf("invalid ssh port: %w", err)
+	}
+	if c.ConnectConcurrency < 0 {
+		return errors.New("connect concurrency can't be negative")
+	}
+	if c.Bastion != nil {
+		if err := c.Bastion.ValidateBasic(c.Droplets); err != nil {
+			return err
+		}
+	}
 	for name, drop := range c.Droplets {
+		if err := validPort(drop.SSHPort); err != nil {
+			return fmt.Errorf("%s has an invalid ssh port: %w", name, err)
+		}
 		for _, peer := range drop.Peers {
 			if _, has := c.Droplets[peer]; !has {
 				return fmt.Errorf(
@@ -134,6 +218,79 @@ func (c Config) ValidateBasic() error {
 				)
 			}
 		}
+		if drop.Netem != nil {
+			if err := drop.Netem.ValidateBasic(); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		for peer, netem := range drop.Links {
+			if _, has := c.Droplets[peer]; !has {
+				return fmt.Errorf(
+					"%s has a link, %s, that is not defined in the Config", name, peer,
+				)
+			}
+			if err := netem.ValidateBasic(); err != nil {
+				return fmt.Errorf("%s link to %s: %w", name, peer, err)
+			}
+		}
+		for _, forward := range drop.Forwards {
+			if _, _, err := ParseForward(forward); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		if drop.HostKey != "" {
+			if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(drop.HostKey)); err != nil {
+				return fmt.Errorf("%s has an invalid host key: %w", name, err)
+			}
+		}
+		endpoints := make(map[string]struct{}, len(drop.Metrics))
+		for _, endpoint := range drop.Metrics {
+			if err := endpoint.ValidateBasic(); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			if _, has := endpoints[endpoint.Name]; has {
+				return fmt.Errorf("%s has multiple metrics endpoints named %s", name, endpoint.Name)
+			}
+			endpoints[endpoint.Name] = struct{}{}
+		}
+	}
+	for _, action := range c.Chaos {
+		if err := action.ValidateBasic(c.Droplets); err != nil {
+			return err
+		}
+	}
+	if c.Metrics != nil {
+		if err := c.Metrics.ValidateBasic(); err != nil {
+			return err
+		}
+	}
+	if c.HydraMetrics != nil {
+		if err := c.HydraMetrics.ValidateBasic(c); err != nil {
+			return err
+		}
+		for name, drop := range c.Droplets {
+			if drop.Type != DHT {
+				continue
+			}
+			for _, endpoint := range drop.Metrics {
+				if endpoint.Name == "hydra" {
+					return fmt.Errorf(
+						"%s has a hydra metrics endpoint, which conflicts with the deprecated hydra_metrics. Remove hydra_metrics",
+						name,
+					)
+				}
+			}
+		}
+	}
+	if c.Resources != nil {
+		if err := c.Resources.ValidateBasic(); err != nil {
+			return err
+		}
+	}
+	if c.KeepAlive != nil {
+		if err := c.KeepAlive.ValidateBasic(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -147,10 +304,18 @@ func WriteConfig(path string, config Config) error {
 	return ioutil.WriteFile(path, configData, 0700)
 }
 
-// WriteIPsJson collects all of the public IPv4s of the existing droplets and writes
-// them to a json file in each unique payload path
+// KnownHostsPath returns the path of the known hosts file of the deployment
+func (c Config) KnownHostsPath() string {
+	if c.KnownHosts != "" {
+		return c.KnownHosts
+	}
+	return fmt.Sprintf("known_hosts_%s.json", c.Tag)
+}
+
+// WriteIPsJson collects the IPv4s of the existing droplets and writes them to a
+// json file in each unique payload path
 func (c Config) WriteIPsJson() error {
-	ips, err := c.exportIPs()
+	ips, err := c.IPs()
 	if err != nil {
 		return err
 	}
@@ -182,7 +347,7 @@ export {{$name}}="{{$ip}}"
 	if err != nil {
 		return err
 	}
-	ips, err := c.exportIPs()
+	ips, err := c.IPs()
 	if err != nil {
 		return err
 	}
@@ -204,13 +369,41 @@ export {{$name}}="{{$ip}}"
 	return nil
 }
 
-func (c Config) exportIPs() (map[string]string, error) {
+// IPs returns the IPv4 each droplet is reached on by the other droplets, keyed
+// by name. That is the public IPv4 of the droplet, or its private IPv4 if it
+// has none, ie because it is only part of a VPC, in which case all the other
+// droplets have to be part of the same VPC. VPCs are regional, and the
+// traffic over them doesn't go through eth0, so private IPv4s are only used
+// when there is no other way to reach a droplet.
+func (c Config) IPs() (map[string]string, error) {
 	out := make(map[string]string)
 	for name, drop := range c.Droplets {
 		ipv4, err := drop.Drop.PublicIPv4()
 		if err != nil {
 			return nil, err
 		}
+		if ipv4 != "" {
+			out[name] = ipv4
+			continue
+		}
+
+		vpc := drop.Drop.VPCUUID
+		for peerName, peer := range c.Droplets {
+			if vpc == "" || peer.Drop.VPCUUID != vpc {
+				return nil, fmt.Errorf(
+					"droplet %s has no public IPv4 and droplet %s isn't part of its VPC",
+					name,
+					peerName,
+				)
+			}
+		}
+		ipv4, err = drop.Drop.PrivateIPv4()
+		if err != nil {
+			return nil, err
+		}
+		if ipv4 == "" {
+			return nil, fmt.Errorf("droplet %s has no IPv4 the other droplets can reach", name)
+		}
 		out[name] = ipv4
 	}
 	return out, nil
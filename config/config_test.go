@@ -0,0 +1,81 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/digitalocean/godo"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPs(t *testing.T) {
+	droplet := func(public, private, vpc string) Droplet {
+		networks := &godo.Networks{}
+		if public != "" {
+			networks.V4 = append(networks.V4, godo.NetworkV4{IPAddress: public, Type: "public"})
+		}
+		if private != "" {
+			networks.V4 = append(networks.V4, godo.NetworkV4{IPAddress: private, Type: "private"})
+		}
+		return Droplet{Drop: godo.Droplet{Networks: networks, VPCUUID: vpc}}
+	}
+
+	tests := []struct {
+		name     string
+		droplets map[string]Droplet
+		want     map[string]string
+		wantErr  bool
+	}{
+		{
+			name: "public",
+			droplets: map[string]Droplet{
+				"a": droplet("203.0.113.1", "10.0.0.1", "vpc"),
+				"b": droplet("203.0.113.2", "10.0.0.2", "other"),
+			},
+			want: map[string]string{"a": "203.0.113.1", "b": "203.0.113.2"},
+		},
+		{
+			// only the droplet without a public IPv4 is reached over the VPC
+			name: "mixed",
+			droplets: map[string]Droplet{
+				"a": droplet("203.0.113.1", "10.0.0.1", "vpc"),
+				"b": droplet("", "10.0.0.2", "vpc"),
+			},
+			want: map[string]string{"a": "203.0.113.1", "b": "10.0.0.2"},
+		},
+		{
+			name: "mixed across VPCs",
+			droplets: map[string]Droplet{
+				"a": droplet("203.0.113.1", "10.0.0.1", "other"),
+				"b": droplet("", "10.0.0.2", "vpc"),
+			},
+			wantErr: true,
+		},
+		{
+			name: "no VPC",
+			droplets: map[string]Droplet{
+				"a": droplet("203.0.113.1", "", ""),
+				"b": droplet("", "10.0.0.2", ""),
+			},
+			wantErr: true,
+		},
+		{
+			name: "no IPv4",
+			droplets: map[string]Droplet{
+				"a": droplet("203.0.113.1", "10.0.0.1", "vpc"),
+				"b": droplet("", "", "vpc"),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ips, err := Config{Droplets: tt.droplets}.IPs()
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, ips)
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseForward parses a port forward in the form "remotePort[:localPort]". The
+// local port is 0 if it isn't specified, letting the OS pick a free one.
+func ParseForward(spec string) (remote, local int, err error) {
+	parts := strings.SplitN(spec, ":", 2)
+	remote, err = parsePort(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid forward %q: %w", spec, err)
+	}
+	if len(parts) == 2 {
+		local, err = parsePort(parts[1])
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid forward %q: %w", spec, err)
+		}
+	}
+	return remote, local, nil
+}
+
+func parsePort(raw string) (int, error) {
+	port, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, err
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port %d out of range", port)
+	}
+	return port, nil
+}
@@ -0,0 +1,41 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		spec       string
+		wantRemote int
+		wantLocal  int
+		wantErr    bool
+	}{
+		{spec: "9758", wantRemote: 9758},
+		{spec: "9758:19758", wantRemote: 9758, wantLocal: 19758},
+		{spec: "1:65535", wantRemote: 1, wantLocal: 65535},
+		{spec: "", wantErr: true},
+		{spec: "abc", wantErr: true},
+		{spec: "0", wantErr: true},
+		{spec: "65536", wantErr: true},
+		{spec: "-1", wantErr: true},
+		{spec: "9758:", wantErr: true},
+		{spec: ":9758", wantErr: true},
+		{spec: "9758:0", wantErr: true},
+		{spec: "9758:1:2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			remote, local, err := ParseForward(tt.spec)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantRemote, remote)
+			require.Equal(t, tt.wantLocal, local)
+		})
+	}
+}
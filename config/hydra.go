@@ -0,0 +1,63 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const defaultHydraMetricsPrefix = "hydrabooster_"
+
+// HydraMetrics configures the scraping of the prometheus metrics served by the
+// hydra booster of each DHT droplet.
+//
+// Deprecated: it is mapped to a "hydra" metrics endpoint on each DHT droplet,
+// which should be declared in the droplets' metrics instead.
+type HydraMetrics struct {
+	// Address is the address of the metrics server on the droplet, defaults
+	// to "127.0.0.1:9758"
+	Address string `json:"address,omitempty"`
+	// Interval is how often the metrics are scraped, ie "10s", defaults to
+	// "5s". It can't differ from the interval of the metrics config.
+	Interval string `json:"interval,omitempty"`
+	// Prefixes filters the stored metrics by name, defaults to
+	// ["hydrabooster_"]
+	Prefixes []string `json:"prefixes,omitempty"`
+}
+
+// Endpoint returns the metrics endpoint the hydra metrics are mapped to
+func (h HydraMetrics) Endpoint() MetricsEndpoint {
+	prefixes := h.Prefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{defaultHydraMetricsPrefix}
+	}
+	return MetricsEndpoint{
+		Name:     "hydra",
+		Address:  h.Address,
+		Prefixes: prefixes,
+	}
+}
+
+func (h HydraMetrics) ValidateBasic(c Config) error {
+	if h.Interval == "" {
+		return nil
+	}
+	interval, err := time.ParseDuration(h.Interval)
+	if err != nil {
+		return fmt.Errorf("invalid hydra metrics interval %q: %w", h.Interval, err)
+	}
+	if interval <= 0 {
+		return errors.New("hydra metrics interval must be positive")
+	}
+	if c.Metrics != nil && c.Metrics.Interval != "" {
+		metrics, err := c.Metrics.IntervalDuration()
+		if err == nil && metrics != interval {
+			return fmt.Errorf(
+				"hydra_metrics interval %s conflicts with the metrics interval %s. hydra_metrics is deprecated, set the interval in metrics only",
+				h.Interval,
+				c.Metrics.Interval,
+			)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultKeepAliveInterval = 15 * time.Second
+	defaultKeepAliveCountMax = 3
+	defaultMaxBackoff        = 30 * time.Second
+	defaultGiveUp            = 10 * time.Minute
+)
+
+// KeepAlive configures how dead ssh connections are detected and
+// re-established
+type KeepAlive struct {
+	// Interval is how often a keepalive request is sent to each host, ie
+	// "30s". The ServerAliveInterval of the ssh config is used if empty,
+	// or else "15s". "0s" turns off the keepalive requests, in which case
+	// only the connections closed by the network are detected.
+	Interval string `json:"interval,omitempty"`
+	// CountMax is the number of intervals without a reply to a keepalive
+	// request after which a connection is considered dead, defaults to 3
+	CountMax int `json:"count_max,omitempty"`
+	// MaxBackoff is the longest wait between two attempts to reconnect, ie
+	// "1m", defaults to "30s"
+	MaxBackoff string `json:"max_backoff,omitempty"`
+	// GiveUp is how long the output of a detached command keeps being
+	// followed while its droplet can't be reached, ie "1h", defaults to
+	// "10m"
+	GiveUp string `json:"give_up,omitempty"`
+}
+
+// IntervalDuration parses the configured interval. ok is false if it isn't
+// configured.
+func (k *KeepAlive) IntervalDuration() (interval time.Duration, ok bool, err error) {
+	if k == nil || k.Interval == "" {
+		return 0, false, nil
+	}
+	interval, err = time.ParseDuration(k.Interval)
+	return interval, true, err
+}
+
+// KeepAliveInterval returns the configured keepalive interval, or else the
+// given ssh config interval if it is positive, or else the default interval
+func (c Config) KeepAliveInterval(sshConfigInterval time.Duration) time.Duration {
+	interval, ok, err := c.KeepAlive.IntervalDuration()
+	switch {
+	case ok && err == nil:
+		return interval
+	case sshConfigInterval > 0:
+		return sshConfigInterval
+	default:
+		return defaultKeepAliveInterval
+	}
+}
+
+// Count returns the configured count or its default
+func (k *KeepAlive) Count() int {
+	if k == nil || k.CountMax == 0 {
+		return defaultKeepAliveCountMax
+	}
+	return k.CountMax
+}
+
+// MaxBackoffDuration parses the configured max backoff or returns its default
+func (k *KeepAlive) MaxBackoffDuration() (time.Duration, error) {
+	if k == nil || k.MaxBackoff == "" {
+		return defaultMaxBackoff, nil
+	}
+	return time.ParseDuration(k.MaxBackoff)
+}
+
+// GiveUpDuration parses the configured give up duration or returns its
+// default
+func (k *KeepAlive) GiveUpDuration() (time.Duration, error) {
+	if k == nil || k.GiveUp == "" {
+		return defaultGiveUp, nil
+	}
+	return time.ParseDuration(k.GiveUp)
+}
+
+func (k *KeepAlive) ValidateBasic() error {
+	interval, _, err := k.IntervalDuration()
+	if err != nil {
+		return fmt.Errorf("invalid keep alive interval %q: %w", k.Interval, err)
+	}
+	if interval < 0 {
+		return errors.New("keep alive interval can't be negative")
+	}
+	if k.CountMax < 0 {
+		return errors.New("keep alive count max can't be negative")
+	}
+	backoff, err := k.MaxBackoffDuration()
+	if err != nil {
+		return fmt.Errorf("invalid keep alive max backoff %q: %w", k.MaxBackoff, err)
+	}
+	if backoff <= 0 {
+		return errors.New("keep alive max backoff must be positive")
+	}
+	giveUp, err := k.GiveUpDuration()
+	if err != nil {
+		return fmt.Errorf("invalid keep alive give up %q: %w", k.GiveUp, err)
+	}
+	if giveUp <= 0 {
+		return errors.New("keep alive give up must be positive")
+	}
+	return nil
+}
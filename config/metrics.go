@@ -0,0 +1,107 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const defaultMetricsInterval = 5 * time.Second
+
+// defaultMetricsAddresses are the addresses of the metrics servers that are
+// commonly run on the droplets, keyed by the name of their endpoint
+var defaultMetricsAddresses = map[string]string{
+	"tendermint":    "127.0.0.1:26660",
+	"hydra":         "127.0.0.1:9758",
+	"node_exporter": "127.0.0.1:9100",
+}
+
+// Metrics configures how the metrics endpoints of the droplets are scraped
+type Metrics struct {
+	// Interval is how often each endpoint is scraped, ie "10s", defaults to
+	// "5s"
+	Interval string `json:"interval,omitempty"`
+	// OpenMetrics additionally writes each scrape to its own OpenMetrics
+	// file so that it can be imported into prometheus, ie using promtool
+	// tsdb create-blocks-from openmetrics
+	OpenMetrics bool `json:"open_metrics,omitempty"`
+}
+
+// IntervalDuration parses the configured interval or returns its default
+func (m *Metrics) IntervalDuration() (time.Duration, error) {
+	if m == nil || m.Interval == "" {
+		return defaultMetricsInterval, nil
+	}
+	return time.ParseDuration(m.Interval)
+}
+
+// MetricsInterval returns how often the metrics endpoints are scraped. The
+// interval of the deprecated hydra metrics is used if the metrics config has
+// none.
+func (c Config) MetricsInterval() (time.Duration, error) {
+	if (c.Metrics == nil || c.Metrics.Interval == "") && c.HydraMetrics != nil && c.HydraMetrics.Interval != "" {
+		return time.ParseDuration(c.HydraMetrics.Interval)
+	}
+	return c.Metrics.IntervalDuration()
+}
+
+// MetricsEndpoints returns the metrics endpoints of the droplet, including
+// the one the deprecated hydra metrics are mapped to for DHT droplets
+func (c Config) MetricsEndpoints(drop Droplet) []MetricsEndpoint {
+	endpoints := drop.Metrics
+	if c.HydraMetrics != nil && drop.Type == DHT {
+		endpoints = append(append([]MetricsEndpoint{}, endpoints...), c.HydraMetrics.Endpoint())
+	}
+	return endpoints
+}
+
+func (m *Metrics) ValidateBasic() error {
+	interval, err := m.IntervalDuration()
+	if err != nil {
+		return fmt.Errorf("invalid metrics interval %q: %w", m.Interval, err)
+	}
+	if interval <= 0 {
+		return errors.New("metrics interval must be positive")
+	}
+	return nil
+}
+
+// MetricsEndpoint is a prometheus metrics server running on a droplet
+type MetricsEndpoint struct {
+	// Name identifies the endpoint in the names of the files it is written
+	// to, ie "tendermint"
+	Name string `json:"name"`
+	// Address is the address of the server on the droplet. It defaults to
+	// the usual address for the names "tendermint", "hydra" and
+	// "node_exporter".
+	Address string `json:"address,omitempty"`
+	// Path is the http path of the metrics, defaults to "/metrics"
+	Path string `json:"path,omitempty"`
+	// Prefixes filters the stored metrics by name. Every metric is stored
+	// if empty.
+	Prefixes []string `json:"prefixes,omitempty"`
+}
+
+// URL returns the url of the endpoint's metrics, using the defaults for any
+// missing fields
+func (e MetricsEndpoint) URL() string {
+	address := e.Address
+	if address == "" {
+		address = defaultMetricsAddresses[e.Name]
+	}
+	path := e.Path
+	if path == "" {
+		path = "/metrics"
+	}
+	return fmt.Sprintf("http://%s%s", address, path)
+}
+
+func (e MetricsEndpoint) ValidateBasic() error {
+	if e.Name == "" {
+		return errors.New("metrics endpoint has no name")
+	}
+	if _, has := defaultMetricsAddresses[e.Name]; !has && e.Address == "" {
+		return fmt.Errorf("metrics endpoint %s has no address", e.Name)
+	}
+	return nil
+}
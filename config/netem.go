@@ -0,0 +1,54 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Netem describes the network conditions emulated on a droplet using tc netem
+type Netem struct {
+	// Latency is the delay added to each outgoing packet
+	// ie "100ms"
+	Latency string `json:"latency,omitempty"`
+	// Jitter is the random variation of the added latency
+	// ie "10ms"
+	Jitter string `json:"jitter,omitempty"`
+	// Loss is the percentage of outgoing packets that are dropped
+	// ie 0.5
+	Loss float64 `json:"loss,omitempty"`
+	// Rate caps the outgoing bandwidth
+	// ie "1mbit"
+	Rate string `json:"rate,omitempty"`
+}
+
+// Args returns the arguments passed to tc netem to emulate the conditions
+func (n Netem) Args() string {
+	var args []string
+	if n.Latency != "" {
+		args = append(args, "delay", n.Latency)
+		if n.Jitter != "" {
+			args = append(args, n.Jitter, "distribution", "normal")
+		}
+	}
+	if n.Loss > 0 {
+		args = append(args, "loss", fmt.Sprintf("%g%%", n.Loss))
+	}
+	if n.Rate != "" {
+		args = append(args, "rate", n.Rate)
+	}
+	return strings.Join(args, " ")
+}
+
+func (n Netem) ValidateBasic() error {
+	if n.Jitter != "" && n.Latency == "" {
+		return errors.New("netem jitter requires a latency")
+	}
+	if n.Loss < 0 || n.Loss > 100 {
+		return fmt.Errorf("netem loss must be a percentage between 0 and 100: %g", n.Loss)
+	}
+	if n.Args() == "" {
+		return errors.New("netem has no latency, loss, or rate configured")
+	}
+	return nil
+}
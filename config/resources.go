@@ -0,0 +1,67 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultResourcesInterval = 5 * time.Second
+	defaultSaturation        = 90
+)
+
+// Resources configures the sampling of the cpu, memory and network usage of
+// each droplet
+type Resources struct {
+	// Disabled turns off the sampling
+	Disabled bool `json:"disabled,omitempty"`
+	// Interval is how often each droplet is sampled, ie "10s", defaults to
+	// "5s"
+	Interval string `json:"interval,omitempty"`
+	// CPUSaturation is the cpu usage in percent above which a droplet is
+	// considered saturated, defaults to 90
+	CPUSaturation float64 `json:"cpu_saturation,omitempty"`
+	// MemorySaturation is the memory usage in percent above which a droplet
+	// is considered saturated, defaults to 90
+	MemorySaturation float64 `json:"memory_saturation,omitempty"`
+}
+
+// IntervalDuration parses the configured interval or returns its default
+func (r *Resources) IntervalDuration() (time.Duration, error) {
+	if r == nil || r.Interval == "" {
+		return defaultResourcesInterval, nil
+	}
+	return time.ParseDuration(r.Interval)
+}
+
+// Saturation returns the configured cpu and memory saturation thresholds or
+// their defaults
+func (r *Resources) Saturation() (cpu, memory float64) {
+	cpu, memory = defaultSaturation, defaultSaturation
+	if r == nil {
+		return cpu, memory
+	}
+	if r.CPUSaturation != 0 {
+		cpu = r.CPUSaturation
+	}
+	if r.MemorySaturation != 0 {
+		memory = r.MemorySaturation
+	}
+	return cpu, memory
+}
+
+func (r *Resources) ValidateBasic() error {
+	interval, err := r.IntervalDuration()
+	if err != nil {
+		return fmt.Errorf("invalid resources interval %q: %w", r.Interval, err)
+	}
+	if interval <= 0 {
+		return errors.New("resources interval must be positive")
+	}
+	cpu, memory := r.Saturation()
+	if cpu < 0 || cpu > 100 || memory < 0 || memory > 100 {
+		return errors.New("resource saturation thresholds must be between 0 and 100")
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultSSHUser            = "root"
+	defaultSSHPort            = 22
+	defaultConnectConcurrency = 32
+)
+
+// Bastion is a jump host used to reach the droplets that don't have a public
+// IPv4, ie because they are only part of a VPC
+type Bastion struct {
+	// Droplet is the name of the droplet used as the bastion. Host is used
+	// if empty.
+	Droplet string `json:"droplet,omitempty"`
+	// Host is the address of a bastion that is not part of the deployment,
+	// ie "203.0.113.7" or "203.0.113.7:2222"
+	Host string `json:"host,omitempty"`
+	// User defaults to the deployment's ssh user
+	User string `json:"user,omitempty"`
+	// HostKey is the expected host key of the Host in the authorized_keys
+	// format. The key recorded in the known hosts file is used if empty.
+	HostKey string `json:"host_key,omitempty"`
+}
+
+func (b Bastion) ValidateBasic(droplets map[string]Droplet) error {
+	switch {
+	case b.Droplet != "" && b.Host != "":
+		return errors.New("bastion can't have both a droplet and a host")
+	case b.Droplet != "":
+		if _, has := droplets[b.Droplet]; !has {
+			return fmt.Errorf("bastion droplet %s is not defined in the Config", b.Droplet)
+		}
+	case b.Host != "":
+		if _, _, err := b.Address(0); err != nil {
+			return err
+		}
+	default:
+		return errors.New("bastion needs a droplet or a host")
+	}
+	if b.HostKey != "" {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(b.HostKey)); err != nil {
+			return fmt.Errorf("bastion has an invalid host key: %w", err)
+		}
+	}
+	return nil
+}
+
+// Address returns the host and the "host:port" address of the Host, using
+// defaultPort if the Host has no port
+func (b Bastion) Address(defaultPort int) (string, string, error) {
+	host, port, err := net.SplitHostPort(b.Host)
+	if err != nil {
+		// no port
+		host, port = b.Host, strconv.Itoa(defaultPort)
+	}
+	if host == "" {
+		return "", "", fmt.Errorf("invalid bastion host %q", b.Host)
+	}
+	return host, net.JoinHostPort(host, port), nil
+}
+
+// BastionIPs returns the addresses the bastion reaches the droplets from,
+// which are its Host or both IPv4s of its droplet, or nil if there is no
+// bastion
+func (c Config) BastionIPs() ([]string, error) {
+	switch {
+	case c.Bastion == nil:
+		return nil, nil
+	case c.Bastion.Host != "":
+		host, _, err := c.Bastion.Address(0)
+		if err != nil {
+			return nil, err
+		}
+		return []string{host}, nil
+	}
+	drop := c.Droplets[c.Bastion.Droplet].Drop
+	var ips []string
+	for _, ipv4 := range []func() (string, error){drop.PublicIPv4, drop.PrivateIPv4} {
+		ip, err := ipv4()
+		if err != nil {
+			return nil, err
+		}
+		if ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+// SSHUserFor returns the user used to connect to the droplet
+func (c Config) SSHUserFor(drop Droplet) string {
+	switch {
+	case drop.SSHUser != "":
+		return drop.SSHUser
+	case c.SSHUser != "":
+		return c.SSHUser
+	default:
+		return defaultSSHUser
+	}
+}
+
+// SSHPortFor returns the port used to connect to the droplet
+func (c Config) SSHPortFor(drop Droplet) int {
+	switch {
+	case drop.SSHPort != 0:
+		return drop.SSHPort
+	case c.SSHPort != 0:
+		return c.SSHPort
+	default:
+		return defaultSSHPort
+	}
+}
+
+// ConnectLimit returns the number of droplets connected to at the same time
+func (c Config) ConnectLimit() int {
+	if c.ConnectConcurrency == 0 {
+		return defaultConnectConcurrency
+	}
+	return c.ConnectConcurrency
+}
+
+// BastionUser returns the user used to connect to the bastion host
+func (c Config) BastionUser() string {
+	if c.Bastion != nil && c.Bastion.User != "" {
+		return c.Bastion.User
+	}
+	return c.SSHUserFor(Droplet{})
+}
+
+// SSHAddress returns the IPv4 used to connect to the droplet, and whether it
+// has to be reached through the bastion because it has no public IPv4
+func (c Config) SSHAddress(drop Droplet) (string, bool, error) {
+	public, err := drop.Drop.PublicIPv4()
+	if err != nil {
+		return "", false, err
+	}
+	if public != "" {
+		return public, false, nil
+	}
+	if c.Bastion == nil {
+		return "", false, fmt.Errorf("droplet %s has no public IPv4 and no bastion is configured", drop.Drop.Name)
+	}
+	private, err := drop.Drop.PrivateIPv4()
+	if err != nil {
+		return "", false, err
+	}
+	if private == "" {
+		return "", false, fmt.Errorf("droplet %s has no IPv4", drop.Drop.Name)
+	}
+	return private, true, nil
+}
+
+func validPort(port int) error {
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("port %d out of range", port)
+	}
+	return nil
+}
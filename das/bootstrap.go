@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/lazyledger/lazyledger-core/ipfs"
+	"github.com/lazyledger/lazyledger-core/libs/log"
+	"github.com/lazyledger/lazyledger-core/p2p/ipld"
+	tmclient "github.com/lazyledger/lazyledger-core/rpc/jsonrpc/client"
+	"github.com/lazyledger/lazyledger-core/types"
+	"github.com/spf13/cobra"
+)
+
+func bootstrapBenchCmd() *cobra.Command {
+	var (
+		runs            int
+		bootstrapConfig string
+		host            string
+		k               int
+		timeout         time.Duration
+		out             string
+	)
+	cmd := &cobra.Command{
+		Use:     "bootstrap-bench",
+		Aliases: []string{"bootstrap-bench", "bb"},
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := validateOut(out); err != nil {
+				return err
+			}
+
+			var bootstrap []string
+			if bootstrapConfig != "" {
+				var err error
+				bootstrap, err = readBootstrap(bootstrapConfig)
+				if err != nil {
+					return err
+				}
+			}
+
+			results, err := BootstrapBench(cmd.Context(), BootstrapOptions{
+				Runs:      runs,
+				Bootstrap: bootstrap,
+				Host:      host,
+				K:         k,
+				Timeout:   timeout,
+				Quiet:     out != "",
+			})
+			if out != "" {
+				records := make([]csvRecord, len(results))
+				for i, r := range results {
+					records[i] = newBootstrapRecord(r)
+				}
+				if writeErr := writeRecords(out, bootstrapCSVHeader, records); writeErr != nil {
+					return writeErr
+				}
+			}
+			return err
+		},
+	}
+	cmd.Flags().IntVar(&runs, "runs", 1, "number of fresh IPFS repos to bootstrap")
+	cmd.Flags().StringVar(
+		&bootstrapConfig,
+		"bootstrap-config",
+		"",
+		"path to an IPFS config whose bootstrap peers are used, ie the one updated by add-hydra. The default IPFS bootstrap peers are used if empty",
+	)
+	cmd.Flags().StringVar(
+		&host,
+		"host",
+		"",
+		"tendermint RPC address used to fetch the latest DAH, whose root is looked up in the DHT. The provider lookup is skipped if empty",
+	)
+	cmd.Flags().IntVar(&k, "k", 20, "routing table size to wait for")
+	cmd.Flags().DurationVar(&timeout, "timeout", 2*time.Minute, "maximum duration of each run")
+	cmd.Flags().StringVar(&out, "out", "", outUsage)
+	return cmd
+}
+
+// BootstrapOptions configures a bootstrap benchmark
+type BootstrapOptions struct {
+	// Runs is the number of fresh repos that are bootstrapped
+	Runs int
+	// Bootstrap replaces the default bootstrap peers if not nil
+	Bootstrap []string
+	// Host is the tendermint RPC address used to fetch the DAH whose root is
+	// looked up. The provider lookup is skipped if empty.
+	Host string
+	// K is the routing table size to wait for
+	K int
+	// Timeout is the maximum duration of each run
+	Timeout time.Duration
+	// Quiet doesn't print the #DATA lines of each run, ie because the
+	// results are written to a file
+	Quiet bool
+}
+
+// BootstrapResult contains the durations measured from the start of a fresh
+// IPFS node. Durations of milestones that were not reached are 0.
+type BootstrapResult struct {
+	Run int
+	// FirstPeer is the time until the node connected to its first peer
+	FirstPeer time.Duration
+	// RoutingTableK is the time until the WAN DHT routing table contained K
+	// peers
+	RoutingTableK time.Duration
+	// FirstProvider is the time until the first successful provider lookup
+	// of the DAH root
+	FirstProvider time.Duration
+	Err           error
+}
+
+// BootstrapBench starts a fresh embedded IPFS node for each run and records
+// how long it takes to bootstrap
+func BootstrapBench(ctx context.Context, opts BootstrapOptions) ([]BootstrapResult, error) {
+	logger := log.NewTMLogger(log.NewSyncWriter(os.Stderr))
+
+	root := cid.Undef
+	if opts.Host != "" {
+		client, err := tmclient.New("tcp://" + opts.Host)
+		if err != nil {
+			return nil, fmt.Errorf("failure to create the RPC client: %w", err)
+		}
+		height, err := getLatestHeight(ctx, client)
+		if err != nil {
+			return nil, fmt.Errorf("failure to get the latest height: %w", err)
+		}
+		dah, err := getDAH(ctx, client, height)
+		if err != nil {
+			return nil, fmt.Errorf("failure to get the DAH at height %d: %w", height, err)
+		}
+		root, err = randomRoot(&dah)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	results := make([]BootstrapResult, 0, opts.Runs)
+	for i := 0; i < opts.Runs; i++ {
+		res := bootstrapRun(ctx, opts, root, logger.With("run", i))
+		res.Run = i
+		if !opts.Quiet {
+			printBootstrap(res)
+		}
+		results = append(results, res)
+		if ctx.Err() != nil {
+			return results, ctx.Err()
+		}
+	}
+	return results, nil
+}
+
+// printBootstrap prints the durations measured during a run
+func printBootstrap(res BootstrapResult) {
+	fmt.Printf(
+		"#DATA bootstrap %d first-peer=%dms routing-table-k=%dms first-provider=%dms\n",
+		res.Run,
+		res.FirstPeer.Milliseconds(),
+		res.RoutingTableK.Milliseconds(),
+		res.FirstProvider.Milliseconds(),
+	)
+	if res.Err != nil {
+		fmt.Printf("#DATA bootstrap %d failed: %v\n", res.Run, res.Err)
+	}
+}
+
+// randomRoot returns the CID of a random row or column root of dah
+func randomRoot(dah *types.DataAvailabilityHeader) (cid.Cid, error) {
+	if len(dah.RowsRoots) == 0 {
+		return cid.Undef, errors.New("empty data availability header")
+	}
+	root, _, err := ipld.SampleSquare(uint32(len(dah.RowsRoots)), 1)[0].Leaf(dah)
+	return root, err
+}
+
+// bootstrapRun bootstraps a single fresh node in a temporary repo
+func bootstrapRun(ctx context.Context, opts BootstrapOptions, root cid.Cid, logger log.Logger) BootstrapResult {
+	var res BootstrapResult
+
+	path, err := ioutil.TempDir("", "das-bootstrap-bench")
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	defer os.RemoveAll(path)
+	path = filepath.Join(path, "ipfs")
+
+	// the repo is prepared up front so that key generation isn't measured
+	err = prepareRepo(path, repoOptions{Bootstrap: opts.Bootstrap}, logger)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	node, err := startNode(ipfs.Embedded(false, &ipfs.Config{RepoPath: path}, logger))
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	if node.node == nil {
+		node.Close()
+		res.Err = errors.New("the IPFS provider did not return a full node")
+		return res
+	}
+
+	// look for providers in the background, as each lookup can take a while
+	var wg sync.WaitGroup
+	providerFound := make(chan time.Duration, 1)
+	defer func() {
+		cancel()
+		wg.Wait()
+		node.Close()
+	}()
+	if root.Defined() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if node.Peers() > 0 && findProvider(ctx, node, root) {
+					providerFound <- time.Since(start)
+					return
+				}
+				if err := sleep(ctx, 100*time.Millisecond); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if res.FirstPeer == 0 && node.Peers() > 0 {
+			res.FirstPeer = time.Since(start)
+		}
+		if res.RoutingTableK == 0 && node.node.DHT != nil &&
+			node.node.DHT.WAN.RoutingTable().Size() >= opts.K {
+			res.RoutingTableK = time.Since(start)
+		}
+		select {
+		case res.FirstProvider = <-providerFound:
+		default:
+		}
+		if res.FirstPeer != 0 && res.RoutingTableK != 0 && (res.FirstProvider != 0 || !root.Defined()) {
+			return res
+		}
+
+		select {
+		case <-ctx.Done():
+			res.Err = ctx.Err()
+			return res
+		case <-ticker.C:
+		}
+	}
+}
+
+// sleep waits for d, returning early if ctx is cancelled
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// findProvider reports whether a provider of root could be found within a
+// few seconds
+func findProvider(ctx context.Context, node lightNode, root cid.Cid) bool {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, found := <-node.node.Routing.FindProvidersAsync(ctx, root, 1)
+	return found
+}
+
+var bootstrapCSVHeader = []string{
+	"run",
+	"first_peer_ms",
+	"routing_table_k_ms",
+	"first_provider_ms",
+	"success",
+	"error",
+}
+
+// BootstrapRecord is the stable schema used to write each bootstrap run to
+// an output file
+type BootstrapRecord struct {
+	Run             int     `json:"run"`
+	FirstPeerMs     float64 `json:"first_peer_ms"`
+	RoutingTableKMs float64 `json:"routing_table_k_ms"`
+	FirstProviderMs float64 `json:"first_provider_ms"`
+	Success         bool    `json:"success"`
+	Error           string  `json:"error"`
+}
+
+func newBootstrapRecord(r BootstrapResult) BootstrapRecord {
+	rec := BootstrapRecord{
+		Run:             r.Run,
+		FirstPeerMs:     milliseconds(r.FirstPeer),
+		RoutingTableKMs: milliseconds(r.RoutingTableK),
+		FirstProviderMs: milliseconds(r.FirstProvider),
+		Success:         r.Err == nil,
+	}
+	if r.Err != nil {
+		rec.Error = r.Err.Error()
+	}
+	return rec
+}
+
+func (r BootstrapRecord) csv() []string {
+	return []string{
+		strconv.Itoa(r.Run),
+		strconv.FormatFloat(r.FirstPeerMs, 'f', 3, 64),
+		strconv.FormatFloat(r.RoutingTableKMs, 'f', 3, 64),
+		strconv.FormatFloat(r.FirstProviderMs, 'f', 3, 64),
+		strconv.FormatBool(r.Success),
+		r.Error,
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/lazyledger/lazyledger-core/ipfs"
+	"github.com/lazyledger/lazyledger-core/libs/log"
+	ctypes "github.com/lazyledger/lazyledger-core/rpc/core/types"
+	tmclient "github.com/lazyledger/lazyledger-core/rpc/jsonrpc/client"
+	"github.com/lazyledger/lazyledger-core/types"
+)
+
+// Follow polls the tendermint node at host for new blocks, sampling each new
+// block once until opts.Iterations blocks have been sampled. Failed samples
+// are recorded in the results instead of aborting the run.
+func Follow(ctx context.Context, host string, opts SampleOptions) ([]SampleResult, error) {
+	logger := log.NewTMLogger(log.NewSyncWriter(os.Stderr))
+
+	node, err := startNode(ipfs.Embedded(false, ipfs.DefaultConfig(), logger))
+	if err != nil {
+		return nil, fmt.Errorf("failure to start the IPFS node: %w", err)
+	}
+	defer node.Close()
+
+	client, err := tmclient.New("tcp://" + host)
+	if err != nil {
+		return nil, fmt.Errorf("failure to create the RPC client: %w", err)
+	}
+
+	// only sample blocks committed after we start following
+	last, err := getLatestHeight(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("failure to get the latest height: %w", err)
+	}
+
+	blocks := opts.Iterations
+	pollInterval := opts.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+
+	samples := make([]SampleResult, 0, blocks)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for len(samples) < blocks {
+		select {
+		case <-ctx.Done():
+			return samples, ctx.Err()
+		case <-ticker.C:
+		}
+
+		latest, err := getLatestHeight(ctx, client)
+		if err != nil {
+			return samples, fmt.Errorf("failure to get the latest height: %w", err)
+		}
+
+		for height := last + 1; height <= latest && len(samples) < blocks; height++ {
+			// failed samples are kept, as they are part of the results
+			sample, _ := sampleBlock(ctx, client, node, height, opts)
+			sample.Index = len(samples)
+			sample.Peers = node.Peers()
+			if !opts.Quiet {
+				printSample("follow", sample.Index, sample)
+			}
+			samples = append(samples, sample)
+			last = height
+		}
+	}
+
+	return samples, nil
+}
+
+// sampleBlock fetches the DAH and commit time of the block at height and
+// samples it once. The returned result records any failure.
+func sampleBlock(
+	ctx context.Context,
+	client *tmclient.Client,
+	node lightNode,
+	height int64,
+	opts SampleOptions,
+) (SampleResult, error) {
+	failed := SampleResult{Timestamp: time.Now(), Height: height}
+
+	committed, err := getCommitTime(ctx, client, height)
+	if err != nil {
+		failed.Err = fmt.Errorf("failure to get the commit: %w", err)
+		return failed, failed.Err
+	}
+
+	dah, err := getDAH(ctx, client, height)
+	if err != nil {
+		failed.Err = fmt.Errorf("failure to get the DAH: %w", err)
+		return failed, failed.Err
+	}
+
+	var inst *instrumentation
+	if opts.Instrument {
+		inst = node.startInstrumentation()
+	}
+	result, err := sampleBlockShares(ctx, node, height, &dah, opts.NumSamples, opts.Timeout)
+	if inst != nil {
+		result.Instrumentation = inst.stop()
+	}
+	if err != nil {
+		return result, err
+	}
+	result.SinceCommit = time.Since(committed)
+	return result, nil
+}
+
+// getCommitTime returns the time of the latest precommit included in the
+// commit for the block at height
+func getCommitTime(ctx context.Context, client *tmclient.Client, height int64) (time.Time, error) {
+	var res ctypes.ResultCommit
+	_, err := client.Call(ctx, "commit", map[string]interface{}{"height": height}, &res)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if res.Commit == nil {
+		return time.Time{}, fmt.Errorf("no commit found for height %d", height)
+	}
+
+	var committed time.Time
+	for _, sig := range res.Commit.Signatures {
+		if sig.BlockIDFlag == types.BlockIDFlagCommit && sig.Timestamp.After(committed) {
+			committed = sig.Timestamp
+		}
+	}
+	if committed.IsZero() {
+		return res.Header.Time, nil
+	}
+	return committed, nil
+}
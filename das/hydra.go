@@ -1,17 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	config "github.com/ipfs/go-ipfs-config"
 	fsrepo "github.com/ipfs/go-ipfs-config/serialize"
 	"github.com/lazyledger/lazyledger-core/ipfs"
 	"github.com/lazyledger/lazyledger-core/libs/log"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
 	"github.com/spf13/cobra"
 )
 
@@ -21,7 +29,7 @@ func initCmd() *cobra.Command {
 		Aliases: []string{"init"},
 		Args:    cobra.MinimumNArgs(0),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			logger := log.NewTMLogger(log.NewSyncWriter(os.Stdout))
+			logger := log.NewTMLogger(log.NewSyncWriter(os.Stderr))
 
 			apiProvider := ipfs.Embedded(true, ipfs.DefaultConfig(), logger)
 
@@ -37,87 +45,344 @@ func initCmd() *cobra.Command {
 }
 
 func addHydraCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:     "add-hydra [hydra-IP] [ipfs-config-path]",
+	var opts AddHydraOptions
+	cmd := &cobra.Command{
+		Use:     "add-hydra [hydra-IP[,hydra-IP...]] [ipfs-config-path]",
 		Aliases: []string{"add-hydra"},
 		Args:    cobra.MinimumNArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			hydraIP, cfgPath := args[0], args[1]
-			return AddHydraIDs(cmd.Context(), hydraIP, cfgPath)
+			hydraIPs, cfgPath := strings.Split(args[0], ","), args[1]
+			return AddHydraIDs(cmd.Context(), hydraIPs, cfgPath, opts)
 		},
 	}
+	cmd.Flags().StringVar(
+		&opts.Mode,
+		"mode",
+		BootstrapMerge,
+		"how the hydra peers are added to the existing bootstrap peers: merge appends them, prepend puts them first, replace drops the existing peers",
+	)
+	cmd.Flags().BoolVar(
+		&opts.DryRun,
+		"dry-run",
+		false,
+		"print the changes to the bootstrap peers without writing the config",
+	)
+	cmd.Flags().BoolVar(
+		&opts.PublicOnly,
+		"public-only",
+		false,
+		"only add publicly routable addresses",
+	)
+	cmd.Flags().StringVar(
+		&opts.Transport,
+		"transport",
+		"",
+		"only add addresses using this transport: tcp || quic. All transports are added if empty",
+	)
+	cmd.Flags().BoolVar(
+		&opts.IPv4Only,
+		"ipv4-only",
+		false,
+		"only add IPv4 addresses",
+	)
+	cmd.Flags().DurationVar(
+		&opts.Wait,
+		"wait",
+		time.Minute,
+		"how long to keep polling each hydra until it returns at least one address. Only a single attempt is made if 0",
+	)
+	return cmd
 }
 
-func AddHydraIDs(ctx context.Context, hydraIP, cfgPath string) error {
-	rawIDs, err := getSwarmPeerIDs(context.Background(), fmt.Sprintf("http://%s/heads", hydraIP))
-	if err != nil {
-		return err
+// Modes used to add the hydra peers to the existing bootstrap peers
+const (
+	BootstrapMerge   = "merge"
+	BootstrapPrepend = "prepend"
+	BootstrapReplace = "replace"
+)
+
+// AddHydraOptions configures how hydra peers are added to an IPFS config
+type AddHydraOptions struct {
+	// Mode: merge || prepend || replace
+	Mode string
+	// DryRun prints the changes without writing the config
+	DryRun bool
+	// PublicOnly filters out addresses that aren't publicly routable
+	PublicOnly bool
+	// Transport filters out addresses that don't use this transport, ie tcp
+	// or quic, if not empty
+	Transport string
+	// IPv4Only filters out addresses that don't use IPv4
+	IPv4Only bool
+	// Wait is how long to keep polling each hydra until it is ready
+	Wait time.Duration
+}
+
+const (
+	// hydraRequestTimeout is the timeout of a single request to a hydra
+	hydraRequestTimeout = 5 * time.Second
+	// hydraMaxBackoff is the longest time waited between two requests
+	hydraMaxBackoff = 5 * time.Second
+)
+
+var hydraClient = &http.Client{Timeout: hydraRequestTimeout}
+
+// AddHydraIDs adds the addresses of every head of each hydra to the bootstrap
+// peers of the IPFS config at cfgPath
+func AddHydraIDs(ctx context.Context, hydraIPs []string, cfgPath string, opts AddHydraOptions) error {
+	switch opts.Mode {
+	case BootstrapMerge, BootstrapPrepend, BootstrapReplace:
+	default:
+		return fmt.Errorf("unrecognized bootstrap mode %q, use merge, prepend or replace", opts.Mode)
+	}
+	switch opts.Transport {
+	case "", "tcp", "quic":
+	default:
+		return fmt.Errorf("unrecognized transport %q, use tcp or quic", opts.Transport)
 	}
 
-	ids := rawIDs.IDs()
+	var ids []string
+	for _, hydraIP := range hydraIPs {
+		hydraIDs, err := waitForHydra(ctx, hydraIP, opts)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, hydraIDs...)
+	}
 
 	var cfg config.Config
-	err = fsrepo.ReadConfigFile(cfgPath, &cfg)
+	err := fsrepo.ReadConfigFile(cfgPath, &cfg)
 	if err != nil {
 		return err
 	}
 
-	boots := make([]string, 0)
-	unique := make(map[string]struct{})
-	for _, addr := range cfg.Bootstrap {
-		unique[addr] = struct{}{}
+	boots := mergeBootstrap(cfg.Bootstrap, ids, opts.Mode)
+
+	if opts.DryRun {
+		printBootstrapDiff(cfg.Bootstrap, boots)
+		return nil
+	}
+
+	cfg.Bootstrap = boots
+
+	return fsrepo.WriteConfigFile(cfgPath, cfg)
+}
+
+// mergeBootstrap combines the existing bootstrap addresses with the added
+// ones according to mode. Peers are deduplicated by their peer ID: the
+// existing addresses of a peer that is also added are dropped in favour of
+// the added addresses.
+func mergeBootstrap(existing, added []string, mode string) []string {
+	addedPeers := make(map[string]struct{})
+	for _, addr := range added {
+		addedPeers[bootstrapPeerID(addr)] = struct{}{}
+	}
+
+	var kept []string
+	if mode != BootstrapReplace {
+		for _, addr := range existing {
+			if _, has := addedPeers[bootstrapPeerID(addr)]; has {
+				continue
+			}
+			kept = append(kept, addr)
+		}
+	}
+
+	var combined []string
+	if mode == BootstrapPrepend {
+		combined = append(append(combined, added...), kept...)
+	} else {
+		combined = append(append(combined, kept...), added...)
 	}
 
-	for _, addr := range ids {
+	// drop duplicate addresses while preserving the order
+	boots := make([]string, 0, len(combined))
+	unique := make(map[string]struct{})
+	for _, addr := range combined {
 		if _, has := unique[addr]; has {
 			continue
 		}
+		unique[addr] = struct{}{}
 		boots = append(boots, addr)
 	}
+	return boots
+}
 
-	cfg.Bootstrap = boots
+// bootstrapPeerID returns the peer ID of a bootstrap address, or the address
+// itself if it can't be parsed
+func bootstrapPeerID(addr string) string {
+	maddr, err := multiaddr.NewMultiaddr(addr)
+	if err != nil {
+		return addr
+	}
+	info, err := peer.AddrInfoFromP2pAddr(maddr)
+	if err != nil {
+		return addr
+	}
+	return info.ID.String()
+}
 
-	return fsrepo.WriteConfigFile(cfgPath, cfg)
+// printBootstrapDiff prints each bootstrap address prefixed with + if it is
+// added, - if it is removed, or a space if it is kept
+func printBootstrapDiff(before, after []string) {
+	kept := make(map[string]struct{}, len(after))
+	for _, addr := range after {
+		kept[addr] = struct{}{}
+	}
+	existed := make(map[string]struct{}, len(before))
+	for _, addr := range before {
+		existed[addr] = struct{}{}
+		if _, has := kept[addr]; !has {
+			fmt.Println("-", addr)
+		}
+	}
+	for _, addr := range after {
+		if _, has := existed[addr]; has {
+			fmt.Println(" ", addr)
+		} else {
+			fmt.Println("+", addr)
+		}
+	}
 }
 
-type hydraHeadsResp struct {
+// waitForHydra polls the heads of the hydra with an exponential backoff until
+// it returns at least one address that passes the filters, or until
+// opts.Wait has passed
+func waitForHydra(ctx context.Context, hydraIP string, opts AddHydraOptions) ([]string, error) {
+	if opts.Wait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Wait)
+		defer cancel()
+	}
+
+	var (
+		start   = time.Now()
+		backoff = 250 * time.Millisecond
+		lastErr error
+	)
+	for attempt := 1; ; attempt++ {
+		heads, err := getSwarmPeerIDs(ctx, fmt.Sprintf("http://%s/heads", hydraIP))
+		var ids []string
+		for _, head := range heads {
+			ids = append(ids, head.IDs(opts)...)
+		}
+		switch {
+		case err != nil:
+			lastErr = err
+		case len(ids) == 0:
+			lastErr = errors.New("no addresses found that match the filters")
+		default:
+			fmt.Printf("hydra %s ready after %s (%d attempts)\n", hydraIP, time.Since(start).Round(time.Millisecond), attempt)
+			return ids, nil
+		}
+
+		if opts.Wait <= 0 {
+			break
+		}
+		if err := sleep(ctx, backoff); err != nil {
+			return nil, fmt.Errorf("hydra %s not ready after %s: %w", hydraIP, time.Since(start).Round(time.Millisecond), lastErr)
+		}
+		backoff *= 2
+		if backoff > hydraMaxBackoff {
+			backoff = hydraMaxBackoff
+		}
+	}
+	return nil, fmt.Errorf("failure to get the heads of hydra %s: %w", hydraIP, lastErr)
+}
+
+// hydraHead is a single hydra head as returned by the hydra http API
+type hydraHead struct {
 	Addrs []string `json:"Addrs"`
 	ID    string   `json:"ID"`
 }
 
-func (h hydraHeadsResp) IDs() []string {
-	out := make([]string, len(h.Addrs))
+// IDs returns the p2p addresses of the head that pass the filters of opts
+func (h hydraHead) IDs(opts AddHydraOptions) []string {
+	out := make([]string, 0, len(h.Addrs))
 
-	for i, addr := range h.Addrs {
-		out[i] = fmt.Sprintf("%s/p2p/%s", addr, h.ID)
+	for _, addr := range h.Addrs {
+		if !opts.keep(addr) {
+			continue
+		}
+		out = append(out, fmt.Sprintf("%s/p2p/%s", addr, h.ID))
 	}
 	return out
 }
 
-func getSwarmPeerIDs(ctx context.Context, url string) (hydraHeadsResp, error) {
-	var ids hydraHeadsResp
-	req, err := http.NewRequest("GET", url, nil)
+// keep reports whether addr passes the address filters
+func (opts AddHydraOptions) keep(addr string) bool {
+	maddr, err := multiaddr.NewMultiaddr(addr)
 	if err != nil {
-		return ids, err
+		return false
+	}
+	if opts.PublicOnly && !manet.IsPublicAddr(maddr) {
+		return false
+	}
+	if opts.IPv4Only {
+		if _, err := maddr.ValueForProtocol(multiaddr.P_IP4); err != nil {
+			return false
+		}
+	}
+	switch opts.Transport {
+	case "tcp":
+		if _, err := maddr.ValueForProtocol(multiaddr.P_TCP); err != nil {
+			return false
+		}
+	case "quic":
+		if _, err := maddr.ValueForProtocol(multiaddr.P_QUIC); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// getSwarmPeerIDs fetches the heads of a hydra. The hydra http API streams
+// each head as a separate json object, but a json array is accepted too.
+func getSwarmPeerIDs(ctx context.Context, url string) ([]hydraHead, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
 	}
 
 	req.Header.Set("Accept", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := hydraClient.Do(req)
 	if err != nil {
-		return ids, err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return ids, err
+		return nil, err
 	}
 
-	err = json.Unmarshal(data, &ids)
-	if err != nil {
-		return ids, err
+	return parseHeads(data)
+}
+
+func parseHeads(data []byte) ([]hydraHead, error) {
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("[")) {
+		var heads []hydraHead
+		err := json.Unmarshal(data, &heads)
+		return heads, err
 	}
 
-	return ids, nil
+	var heads []hydraHead
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var head hydraHead
+		err := dec.Decode(&head)
+		if err == io.EOF {
+			return heads, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		heads = append(heads, head)
+	}
 }
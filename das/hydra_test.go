@@ -0,0 +1,194 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	peerA = "QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN"
+	peerB = "QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa"
+	peerC = "QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Nb"
+)
+
+func TestMergeBootstrap(t *testing.T) {
+	var (
+		a1 = "/ip4/1.1.1.1/tcp/4001/p2p/" + peerA
+		a2 = "/ip4/1.1.1.2/tcp/4001/p2p/" + peerA
+		b1 = "/ip4/2.2.2.1/tcp/4001/p2p/" + peerB
+		c1 = "/ip4/3.3.3.1/tcp/4001/p2p/" + peerC
+	)
+	tests := []struct {
+		name     string
+		existing []string
+		added    []string
+		mode     string
+		want     []string
+	}{
+		{
+			name:     "merge appends",
+			existing: []string{a1},
+			added:    []string{b1},
+			mode:     BootstrapMerge,
+			want:     []string{a1, b1},
+		},
+		{
+			name:     "prepend puts the added first",
+			existing: []string{a1},
+			added:    []string{b1},
+			mode:     BootstrapPrepend,
+			want:     []string{b1, a1},
+		},
+		{
+			name:     "replace drops the existing",
+			existing: []string{a1, c1},
+			added:    []string{b1},
+			mode:     BootstrapReplace,
+			want:     []string{b1},
+		},
+		{
+			name:     "added peer replaces its existing addresses",
+			existing: []string{a1, c1},
+			added:    []string{a2},
+			mode:     BootstrapMerge,
+			want:     []string{c1, a2},
+		},
+		{
+			name:     "duplicate added addresses",
+			existing: nil,
+			added:    []string{b1, b1, c1},
+			mode:     BootstrapMerge,
+			want:     []string{b1, c1},
+		},
+		{
+			name:     "readding the same address",
+			existing: []string{a1, b1},
+			added:    []string{a1},
+			mode:     BootstrapPrepend,
+			want:     []string{a1, b1},
+		},
+		{
+			name:     "unparsable addresses are kept as is",
+			existing: []string{"not-a-multiaddr", "not-a-multiaddr"},
+			added:    []string{b1},
+			mode:     BootstrapMerge,
+			want:     []string{"not-a-multiaddr", b1},
+		},
+		{
+			name:     "nothing added",
+			existing: []string{a1},
+			added:    nil,
+			mode:     BootstrapMerge,
+			want:     []string{a1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, mergeBootstrap(tt.existing, tt.added, tt.mode))
+		})
+	}
+}
+
+func TestParseHeads(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []hydraHead
+		wantErr bool
+	}{
+		{
+			name: "ndjson",
+			data: `{"ID":"` + peerA + `","Addrs":["/ip4/1.1.1.1/tcp/4001"]}
+{"ID":"` + peerB + `","Addrs":[]}
+`,
+			want: []hydraHead{
+				{ID: peerA, Addrs: []string{"/ip4/1.1.1.1/tcp/4001"}},
+				{ID: peerB, Addrs: []string{}},
+			},
+		},
+		{
+			name: "concatenated objects",
+			data: `{"ID":"` + peerA + `"}{"ID":"` + peerB + `"}`,
+			want: []hydraHead{{ID: peerA}, {ID: peerB}},
+		},
+		{
+			name: "array",
+			data: ` [{"ID":"` + peerA + `","Addrs":["/ip4/1.1.1.1/tcp/4001"]},{"ID":"` + peerB + `"}]`,
+			want: []hydraHead{
+				{ID: peerA, Addrs: []string{"/ip4/1.1.1.1/tcp/4001"}},
+				{ID: peerB},
+			},
+		},
+		{name: "empty", data: "", want: nil},
+		{name: "empty array", data: "[]", want: []hydraHead{}},
+		{name: "truncated ndjson", data: `{"ID":"` + peerA + `"}` + "\n" + `{"ID":`, wantErr: true},
+		{name: "invalid array", data: `[{"ID":1}]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHeads([]byte(tt.data))
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestHydraHeadIDs(t *testing.T) {
+	head := hydraHead{
+		ID: peerA,
+		Addrs: []string{
+			"/ip4/127.0.0.1/tcp/4001",
+			"/ip4/8.8.8.8/tcp/4001",
+			"/ip4/8.8.8.8/udp/4001/quic",
+			"/ip6/2001:4860:4860::8888/tcp/4001",
+			"not-a-multiaddr",
+		},
+	}
+	tests := []struct {
+		name string
+		opts AddHydraOptions
+		want []string
+	}{
+		{
+			name: "no filters",
+			want: []string{
+				"/ip4/127.0.0.1/tcp/4001/p2p/" + peerA,
+				"/ip4/8.8.8.8/tcp/4001/p2p/" + peerA,
+				"/ip4/8.8.8.8/udp/4001/quic/p2p/" + peerA,
+				"/ip6/2001:4860:4860::8888/tcp/4001/p2p/" + peerA,
+			},
+		},
+		{
+			name: "public only",
+			opts: AddHydraOptions{PublicOnly: true},
+			want: []string{
+				"/ip4/8.8.8.8/tcp/4001/p2p/" + peerA,
+				"/ip4/8.8.8.8/udp/4001/quic/p2p/" + peerA,
+				"/ip6/2001:4860:4860::8888/tcp/4001/p2p/" + peerA,
+			},
+		},
+		{
+			name: "tcp",
+			opts: AddHydraOptions{Transport: "tcp", IPv4Only: true},
+			want: []string{
+				"/ip4/127.0.0.1/tcp/4001/p2p/" + peerA,
+				"/ip4/8.8.8.8/tcp/4001/p2p/" + peerA,
+			},
+		},
+		{
+			name: "quic",
+			opts: AddHydraOptions{Transport: "quic"},
+			want: []string{"/ip4/8.8.8.8/udp/4001/quic/p2p/" + peerA},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, head.IDs(tt.opts))
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bitswap "github.com/ipfs/go-bitswap"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+)
+
+// Instrumentation is the change in the node wide DHT, connection and bitswap
+// counters of the IPFS node during a sample. The provider lookups are the
+// ones bitswap runs to find the shares, and bitswap runs them outside of the
+// sample, so the deltas include the activity of any sample that overlapped
+// with this one.
+type Instrumentation struct {
+	// NodeProviderLookups is the number of DHT provider lookups started by
+	// the node
+	NodeProviderLookups uint64
+	// NodeDHTQueries is the number of DHT queries sent by those lookups
+	NodeDHTQueries uint64
+	// NodeProvidersFound is the number of provider records found by those
+	// lookups
+	NodeProvidersFound uint64
+	// TimeToFirstProvider is the time from the start of the sample until the
+	// node found a provider, or 0 if it found none
+	TimeToFirstProvider time.Duration
+	// NodePeersDialed is the number of outbound connections opened by the
+	// node
+	NodePeersDialed uint64
+	// NodeBlocksReceived is the number of blocks received via bitswap
+	NodeBlocksReceived uint64
+	// NodeBytesReceived is the amount of block data received via bitswap
+	NodeBytesReceived uint64
+	// Overlapped is true if other samples ran on the node during this one,
+	// in which case the deltas aren't only due to this sample
+	Overlapped bool
+}
+
+// nodeCounters counts the DHT lookups and the connections of a node, and the
+// samples instrumented on it
+type nodeCounters struct {
+	dialed    uint64
+	lookups   uint64
+	queries   uint64
+	providers uint64
+	// started is the number of instrumented samples started so far, and
+	// running the number of those that haven't stopped yet
+	started uint64
+	running int64
+
+	mut sync.Mutex
+	// waiting are the running samples for which no provider was found yet
+	waiting map[*instrumentation]struct{}
+}
+
+func newNodeCounters() *nodeCounters {
+	return &nodeCounters{waiting: make(map[*instrumentation]struct{})}
+}
+
+func (c *nodeCounters) connected(_ network.Network, conn network.Conn) {
+	if conn.Stat().Direction == network.DirOutbound {
+		atomic.AddUint64(&c.dialed, 1)
+	}
+}
+
+// foundProvider counts a provider record, which is the first one for every
+// sample that was waiting for one
+func (c *nodeCounters) foundProvider() {
+	atomic.AddUint64(&c.providers, 1)
+	now := time.Now()
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for inst := range c.waiting {
+		inst.firstProvider = now.Sub(inst.start)
+		delete(c.waiting, inst)
+	}
+}
+
+// countingRouting counts the provider lookups of the routing it wraps, along
+// with the DHT queries they send and the providers they find
+type countingRouting struct {
+	routing.Routing
+	counters *nodeCounters
+}
+
+func (r countingRouting) FindProvidersAsync(ctx context.Context, key cid.Cid, count int) <-chan peer.AddrInfo {
+	atomic.AddUint64(&r.counters.lookups, 1)
+	ctx, events := routing.RegisterForQueryEvents(ctx)
+	go func() {
+		// the DHT blocks on the events until they are read
+		for e := range events {
+			if e.Type == routing.SendingQuery {
+				atomic.AddUint64(&r.counters.queries, 1)
+			}
+		}
+	}()
+
+	providers := r.Routing.FindProvidersAsync(ctx, key, count)
+	out := make(chan peer.AddrInfo)
+	go func() {
+		defer close(out)
+		for p := range providers {
+			r.counters.foundProvider()
+			select {
+			case out <- p:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return out
+}
+
+// instrumentation records the activity of a node while a sample is taken
+type instrumentation struct {
+	node   lightNode
+	start  time.Time
+	before Instrumentation
+	// started is the value of the node's started counter once this sample
+	// started
+	started    uint64
+	overlapped bool
+	// firstProvider is guarded by the node counters' mutex
+	firstProvider time.Duration
+}
+
+// startInstrumentation snapshots the node's counters before a sample
+func (n lightNode) startInstrumentation() *instrumentation {
+	inst := &instrumentation{
+		node:   n,
+		start:  time.Now(),
+		before: n.counters(),
+	}
+	if d := n.dials; d != nil {
+		inst.started = atomic.AddUint64(&d.started, 1)
+		inst.overlapped = atomic.AddInt64(&d.running, 1) > 1
+		d.mut.Lock()
+		d.waiting[inst] = struct{}{}
+		d.mut.Unlock()
+	}
+	return inst
+}
+
+// stop returns the change in the node's counters since the instrumentation
+// started
+func (i *instrumentation) stop() *Instrumentation {
+	after := i.node.counters()
+	overlapped := i.overlapped
+	var firstProvider time.Duration
+	if d := i.node.dials; d != nil {
+		atomic.AddInt64(&d.running, -1)
+		// another sample started after this one
+		overlapped = overlapped || atomic.LoadUint64(&d.started) != i.started
+		d.mut.Lock()
+		delete(d.waiting, i)
+		firstProvider = i.firstProvider
+		d.mut.Unlock()
+	}
+	return &Instrumentation{
+		NodeProviderLookups: after.NodeProviderLookups - i.before.NodeProviderLookups,
+		NodeDHTQueries:      after.NodeDHTQueries - i.before.NodeDHTQueries,
+		NodeProvidersFound:  after.NodeProvidersFound - i.before.NodeProvidersFound,
+		TimeToFirstProvider: firstProvider,
+		NodePeersDialed:     after.NodePeersDialed - i.before.NodePeersDialed,
+		NodeBlocksReceived:  after.NodeBlocksReceived - i.before.NodeBlocksReceived,
+		NodeBytesReceived:   after.NodeBytesReceived - i.before.NodeBytesReceived,
+		Overlapped:          overlapped,
+	}
+}
+
+// counters returns the node wide counters of the node
+func (n lightNode) counters() Instrumentation {
+	var c Instrumentation
+	if d := n.dials; d != nil {
+		c.NodeProviderLookups = atomic.LoadUint64(&d.lookups)
+		c.NodeDHTQueries = atomic.LoadUint64(&d.queries)
+		c.NodeProvidersFound = atomic.LoadUint64(&d.providers)
+		c.NodePeersDialed = atomic.LoadUint64(&d.dialed)
+	}
+	if n.node == nil {
+		return c
+	}
+	if bs, ok := n.node.Exchange.(*bitswap.Bitswap); ok {
+		stat, err := bs.Stat()
+		if err == nil {
+			c.NodeBlocksReceived = stat.BlocksReceived
+			c.NodeBytesReceived = stat.DataReceived
+		}
+	}
+	return c
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstrumentation(t *testing.T) {
+	type step struct {
+		// start starts the instrumentation of sample i, or stops it if false
+		start  bool
+		sample int
+		// the node counters added before the step
+		lookups, providers uint64
+	}
+	tests := []struct {
+		name           string
+		steps          []step
+		wantLookups    []uint64
+		wantProviders  []uint64
+		wantOverlapped []bool
+	}{
+		{
+			name: "single sample",
+			steps: []step{
+				{start: true, sample: 0, lookups: 5},
+				{sample: 0, lookups: 2, providers: 3},
+			},
+			wantLookups:    []uint64{2},
+			wantProviders:  []uint64{3},
+			wantOverlapped: []bool{false},
+		},
+		{
+			name: "sequential samples",
+			steps: []step{
+				{start: true, sample: 0},
+				{sample: 0, lookups: 1},
+				{start: true, sample: 1, lookups: 4},
+				{sample: 1, lookups: 2},
+			},
+			wantLookups:    []uint64{1, 2},
+			wantProviders:  []uint64{0, 0},
+			wantOverlapped: []bool{false, false},
+		},
+		{
+			// the deltas of both samples include the overlap
+			name: "overlapping samples",
+			steps: []step{
+				{start: true, sample: 0},
+				{start: true, sample: 1, lookups: 1},
+				{sample: 0, lookups: 2},
+				{sample: 1, lookups: 4},
+			},
+			wantLookups:    []uint64{3, 6},
+			wantProviders:  []uint64{0, 0},
+			wantOverlapped: []bool{true, true},
+		},
+		{
+			// the sample that started first doesn't see the later one
+			// when it starts, but does once it stops
+			name: "nested sample",
+			steps: []step{
+				{start: true, sample: 0},
+				{start: true, sample: 1},
+				{sample: 1, providers: 1},
+				{sample: 0},
+			},
+			wantLookups:    []uint64{0, 0},
+			wantProviders:  []uint64{1, 1},
+			wantOverlapped: []bool{true, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := lightNode{dials: newNodeCounters()}
+			insts := make([]*instrumentation, len(tt.wantLookups))
+			got := make([]*Instrumentation, len(tt.wantLookups))
+			for _, s := range tt.steps {
+				atomic.AddUint64(&node.dials.lookups, s.lookups)
+				for i := uint64(0); i < s.providers; i++ {
+					node.dials.foundProvider()
+				}
+				if s.start {
+					insts[s.sample] = node.startInstrumentation()
+				} else {
+					got[s.sample] = insts[s.sample].stop()
+				}
+			}
+			for i, in := range got {
+				require.Equal(t, tt.wantLookups[i], in.NodeProviderLookups, "lookups of sample %d", i)
+				require.Equal(t, tt.wantProviders[i], in.NodeProvidersFound, "providers of sample %d", i)
+				require.Equal(t, tt.wantOverlapped[i], in.Overlapped, "overlap of sample %d", i)
+				require.Equal(t, tt.wantProviders[i] > 0, in.TimeToFirstProvider > 0, "first provider of sample %d", i)
+			}
+			require.Empty(t, node.dials.waiting)
+			require.Zero(t, node.dials.running)
+		})
+	}
+}
+
+func TestTimeToFirstProvider(t *testing.T) {
+	node := lightNode{dials: newNodeCounters()}
+	// a provider found before the sample doesn't count
+	node.dials.foundProvider()
+	inst := node.startInstrumentation()
+	time.Sleep(10 * time.Millisecond)
+	node.dials.foundProvider()
+	time.Sleep(10 * time.Millisecond)
+	node.dials.foundProvider()
+
+	in := inst.stop()
+	require.Equal(t, uint64(2), in.NodeProvidersFound)
+	require.True(t, in.TimeToFirstProvider >= 10*time.Millisecond)
+	require.True(t, in.TimeToFirstProvider < 20*time.Millisecond+time.Second)
+}
+
+// fakeRouting sends a query event for each of its queries and then returns
+// its providers
+type fakeRouting struct {
+	routing.Routing
+	queries   int
+	providers []peer.AddrInfo
+}
+
+func (f fakeRouting) FindProvidersAsync(ctx context.Context, _ cid.Cid, _ int) <-chan peer.AddrInfo {
+	out := make(chan peer.AddrInfo)
+	go func() {
+		defer close(out)
+		for i := 0; i < f.queries; i++ {
+			routing.PublishQueryEvent(ctx, &routing.QueryEvent{Type: routing.SendingQuery})
+		}
+		// other events aren't counted
+		routing.PublishQueryEvent(ctx, &routing.QueryEvent{Type: routing.PeerResponse})
+		for _, p := range f.providers {
+			out <- p
+		}
+	}()
+	return out
+}
+
+func TestCountingRouting(t *testing.T) {
+	counters := newNodeCounters()
+	r := countingRouting{
+		Routing: fakeRouting{
+			queries:   3,
+			providers: []peer.AddrInfo{{ID: peer.ID("a")}, {ID: peer.ID("b")}},
+		},
+		counters: counters,
+	}
+
+	for lookup := 0; lookup < 2; lookup++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		var found []peer.AddrInfo
+		for p := range r.FindProvidersAsync(ctx, cid.Undef, 0) {
+			found = append(found, p)
+		}
+		cancel()
+		require.Len(t, found, 2)
+	}
+
+	require.Equal(t, uint64(2), atomic.LoadUint64(&counters.lookups))
+	require.Equal(t, uint64(4), atomic.LoadUint64(&counters.providers))
+	// the events are counted as they are read
+	require.Eventually(t, func() bool {
+		return atomic.LoadUint64(&counters.queries) == 6
+	}, time.Second, time.Millisecond)
+}
@@ -2,21 +2,48 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	_ "net/http/pprof"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
 func main() {
+	rand.Seed(time.Now().UnixNano())
+
+	var pprofAddr string
 	rootCmd := cobra.Command{
 		Use:     "das",
 		Aliases: []string{"das"},
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if pprofAddr == "" {
+				return
+			}
+			go func() {
+				err := http.ListenAndServe(pprofAddr, nil)
+				if err != nil {
+					log.Println(fmt.Errorf("failure to serve pprof: %w", err))
+				}
+			}()
+		},
 	}
+	rootCmd.PersistentFlags().StringVar(
+		&pprofAddr,
+		"pprof-addr",
+		"",
+		"address to serve pprof profiles on, ie 127.0.0.1:6061. Profiling is disabled if empty",
+	)
 
 	rootCmd.AddCommand(
 		sampleCmd(),
 		initCmd(),
 		addHydraCmd(),
+		swarmCmd(),
+		bootstrapBenchCmd(),
 	)
 
 	if err := rootCmd.Execute(); err != nil {
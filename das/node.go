@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+
+	"github.com/ipfs/go-datastore"
+	config "github.com/ipfs/go-ipfs-config"
+	fsrepo "github.com/ipfs/go-ipfs-config/serialize"
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/node/libp2p"
+	coreiface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/lazyledger/lazyledger-core/ipfs"
+	"github.com/lazyledger/lazyledger-core/libs/log"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+	record "github.com/libp2p/go-libp2p-record"
+)
+
+// the embedded IPFS nodes build their routing using libp2p.DHTOption, which
+// is wrapped so that the provider lookups bitswap runs can be counted
+func init() {
+	libp2p.DHTOption = countingDHTOption(libp2p.DHTOption)
+}
+
+// routedCounters are the counters of the nodes whose routing was built by
+// countingDHTOption, keyed by peer ID until the node is started
+var routedCounters = struct {
+	sync.Mutex
+	byPeer map[peer.ID]*nodeCounters
+}{byPeer: make(map[peer.ID]*nodeCounters)}
+
+// countingDHTOption wraps the routing built by option with a countingRouting
+func countingDHTOption(option libp2p.RoutingOption) libp2p.RoutingOption {
+	return func(
+		ctx context.Context,
+		h host.Host,
+		dstore datastore.Batching,
+		validator record.Validator,
+		bootstrapPeers ...peer.AddrInfo,
+	) (routing.Routing, error) {
+		r, err := option(ctx, h, dstore, validator, bootstrapPeers...)
+		if err != nil {
+			return nil, err
+		}
+		counters := newNodeCounters()
+		routedCounters.Lock()
+		routedCounters.byPeer[h.ID()] = counters
+		routedCounters.Unlock()
+		// the DHT is closed when ctx, the node's lifecycle, is done
+		return countingRouting{Routing: r, counters: counters}, nil
+	}
+}
+
+// takeCounters returns the counters of the node's routing, or new ones if
+// it wasn't built by countingDHTOption
+func takeCounters(id peer.ID) *nodeCounters {
+	routedCounters.Lock()
+	defer routedCounters.Unlock()
+	counters, has := routedCounters.byPeer[id]
+	if !has {
+		return newNodeCounters()
+	}
+	delete(routedCounters.byPeer, id)
+	return counters
+}
+
+// repoOptions customizes the IPFS config of a repo before its node is started
+type repoOptions struct {
+	// SwarmPort is the tcp port the node listens on. A random port is used
+	// if 0.
+	SwarmPort int
+	// Bootstrap replaces the bootstrap peers of the repo if not nil
+	Bootstrap []string
+}
+
+// lightNode is an embedded IPFS node used to sample blocks
+type lightNode struct {
+	coreiface.APIDagService
+	closer io.Closer
+	// node is nil if the provider does not embed a full IPFS node
+	node  *core.IpfsNode
+	dials *nodeCounters
+}
+
+// startNode starts the IPFS node provided by provider
+func startNode(provider ipfs.APIProvider) (lightNode, error) {
+	dag, cls, err := provider()
+	if err != nil {
+		return lightNode{}, err
+	}
+	node, _ := cls.(*core.IpfsNode)
+	dials := newNodeCounters()
+	if node != nil {
+		dials = takeCounters(node.Identity)
+	}
+	if node != nil && node.PeerHost != nil {
+		node.PeerHost.Network().Notify(&network.NotifyBundle{ConnectedF: dials.connected})
+	}
+	return lightNode{
+		APIDagService: dag,
+		closer:        cls,
+		node:          node,
+		dials:         dials,
+	}, nil
+}
+
+func (n lightNode) Close() error {
+	return n.closer.Close()
+}
+
+// Peers returns the number of peers the node is connected to, or -1 if
+// unknown
+func (n lightNode) Peers() int {
+	if n.node == nil || n.node.PeerHost == nil {
+		return -1
+	}
+	return len(n.node.PeerHost.Network().Peers())
+}
+
+// newEmbeddedNode initializes an IPFS repo at path if there isn't one yet,
+// applies opts to its config and starts an embedded IPFS node using it
+func newEmbeddedNode(path string, opts repoOptions, logger log.Logger) (lightNode, error) {
+	err := prepareRepo(path, opts, logger)
+	if err != nil {
+		return lightNode{}, err
+	}
+	return startNode(ipfs.Embedded(false, &ipfs.Config{RepoPath: path}, logger))
+}
+
+// prepareRepo initializes an IPFS repo at path if there isn't one yet and
+// applies opts to its config
+func prepareRepo(path string, opts repoOptions, logger log.Logger) error {
+	err := ipfs.InitRepo(path, logger)
+	if err != nil {
+		return err
+	}
+
+	cfgPath := filepath.Join(path, "config")
+	var cfg config.Config
+	err = fsrepo.ReadConfigFile(cfgPath, &cfg)
+	if err != nil {
+		return err
+	}
+
+	cfg.Addresses.Swarm = []string{fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", opts.SwarmPort)}
+	// the nodes are never used via the API, so don't reserve a port for it
+	cfg.Addresses.API = nil
+	if opts.Bootstrap != nil {
+		cfg.Bootstrap = opts.Bootstrap
+	}
+
+	return fsrepo.WriteConfigFile(cfgPath, cfg)
+}
+
+// readBootstrap returns the bootstrap peers of the IPFS config at cfgPath
+func readBootstrap(cfgPath string) ([]string, error) {
+	var cfg config.Config
+	err := fsrepo.ReadConfigFile(cfgPath, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Bootstrap, nil
+}
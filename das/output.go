@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	outUsage        = "file to write the results to instead of printing them and their #DATA lines to stdout, in which case the summary is printed to stderr. The format is picked using the extension: .json, .jsonl or .csv"
+	timeoutUsage    = "maximum time spent on a single sample before it is recorded as failed"
+	instrumentUsage = "record the DHT provider lookups, DHT queries and providers found by bitswap, the time to the first provider, the peers dialed and the bitswap blocks and bytes received during each sample. The counts are node wide, so they include the activity of overlapping samples, which is flagged"
+)
+
+// Record is the stable schema used to write each sample to an output file
+type Record struct {
+	Timestamp     time.Time     `json:"timestamp"`
+	Client        int           `json:"client"`
+	Height        int64         `json:"height"`
+	DAHHash       string        `json:"dah_hash"`
+	SampleIndex   int           `json:"sample_index"`
+	DurationMs    float64       `json:"duration_ms"`
+	SinceCommitMs float64       `json:"since_commit_ms"`
+	Samples       int           `json:"samples"`
+	Confidence    float64       `json:"confidence"`
+	Success       bool          `json:"success"`
+	Error         string        `json:"error"`
+	PeerCount     int           `json:"peer_count"`
+	Shares        []ShareRecord `json:"shares"`
+	// Instrumentation is null unless instrumentation is enabled
+	Instrumentation *InstrumentationRecord `json:"instrumentation"`
+}
+
+// InstrumentationRecord is the stable schema used to write the change in
+// the node wide counters during a sample
+type InstrumentationRecord struct {
+	NodeProviderLookups   uint64  `json:"node_provider_lookups"`
+	NodeDHTQueries        uint64  `json:"node_dht_queries"`
+	NodeProvidersFound    uint64  `json:"node_providers_found"`
+	TimeToFirstProviderMs float64 `json:"time_to_first_provider_ms"`
+	NodePeersDialed       uint64  `json:"node_peers_dialed"`
+	NodeBlocksReceived    uint64  `json:"node_bitswap_blocks_received"`
+	NodeBytesReceived     uint64  `json:"node_bitswap_bytes_received"`
+	Overlapped            bool    `json:"overlapped"`
+}
+
+// ShareRecord is the stable schema used to write the retrieval of a single
+// share
+type ShareRecord struct {
+	Row        uint32  `json:"row"`
+	Col        uint32  `json:"col"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+var csvHeader = []string{
+	"timestamp",
+	"client",
+	"height",
+	"dah_hash",
+	"sample_index",
+	"duration_ms",
+	"since_commit_ms",
+	"samples",
+	"confidence",
+	"success",
+	"error",
+	"peer_count",
+	"share_durations_ms",
+	"node_provider_lookups",
+	"node_dht_queries",
+	"node_providers_found",
+	"time_to_first_provider_ms",
+	"node_peers_dialed",
+	"node_bitswap_blocks_received",
+	"node_bitswap_bytes_received",
+	"overlapped",
+}
+
+func newRecord(r SampleResult) Record {
+	rec := Record{
+		Timestamp:     r.Timestamp.UTC(),
+		Client:        r.Client,
+		Height:        r.Height,
+		DAHHash:       hex.EncodeToString(r.DAHHash),
+		SampleIndex:   r.Index,
+		DurationMs:    milliseconds(r.Duration),
+		SinceCommitMs: milliseconds(r.SinceCommit),
+		Samples:       len(r.Shares),
+		Confidence:    r.Confidence,
+		Success:       r.Err == nil,
+		PeerCount:     r.Peers,
+		Shares:        make([]ShareRecord, len(r.Shares)),
+	}
+	if r.Err != nil {
+		rec.Error = r.Err.Error()
+	}
+	for i, s := range r.Shares {
+		rec.Shares[i] = ShareRecord{Row: s.Row, Col: s.Col, DurationMs: milliseconds(s.Duration)}
+	}
+	if in := r.Instrumentation; in != nil {
+		rec.Instrumentation = &InstrumentationRecord{
+			NodeProviderLookups:   in.NodeProviderLookups,
+			NodeDHTQueries:        in.NodeDHTQueries,
+			NodeProvidersFound:    in.NodeProvidersFound,
+			TimeToFirstProviderMs: milliseconds(in.TimeToFirstProvider),
+			NodePeersDialed:       in.NodePeersDialed,
+			NodeBlocksReceived:    in.NodeBlocksReceived,
+			NodeBytesReceived:     in.NodeBytesReceived,
+			Overlapped:            in.Overlapped,
+		}
+	}
+	return rec
+}
+
+func (r Record) csv() []string {
+	shares := make([]string, len(r.Shares))
+	for i, s := range r.Shares {
+		shares[i] = strconv.FormatFloat(s.DurationMs, 'f', 3, 64)
+	}
+	// the instrumentation columns are left empty unless it is enabled
+	inst := make([]string, 8)
+	if in := r.Instrumentation; in != nil {
+		inst = []string{
+			strconv.FormatUint(in.NodeProviderLookups, 10),
+			strconv.FormatUint(in.NodeDHTQueries, 10),
+			strconv.FormatUint(in.NodeProvidersFound, 10),
+			strconv.FormatFloat(in.TimeToFirstProviderMs, 'f', 3, 64),
+			strconv.FormatUint(in.NodePeersDialed, 10),
+			strconv.FormatUint(in.NodeBlocksReceived, 10),
+			strconv.FormatUint(in.NodeBytesReceived, 10),
+			strconv.FormatBool(in.Overlapped),
+		}
+	}
+	return append([]string{
+		r.Timestamp.Format(time.RFC3339Nano),
+		strconv.Itoa(r.Client),
+		strconv.FormatInt(r.Height, 10),
+		r.DAHHash,
+		strconv.Itoa(r.SampleIndex),
+		strconv.FormatFloat(r.DurationMs, 'f', 3, 64),
+		strconv.FormatFloat(r.SinceCommitMs, 'f', 3, 64),
+		strconv.Itoa(r.Samples),
+		strconv.FormatFloat(r.Confidence, 'f', 6, 64),
+		strconv.FormatBool(r.Success),
+		r.Error,
+		strconv.Itoa(r.PeerCount),
+		strings.Join(shares, ";"),
+	}, inst...)
+}
+
+// report writes the results to out and their summary to stderr, or else
+// prints them to stdout followed by their summary
+func report(results []SampleResult, out string) error {
+	if out != "" {
+		fmt.Fprintln(os.Stderr, summarize(results))
+		return writeResults(out, results)
+	}
+
+	fmt.Println("data-start--------------")
+	for i, r := range results {
+		shares := make([]string, len(r.Shares))
+		for j, s := range r.Shares {
+			shares[j] = strconv.FormatInt(s.Duration.Milliseconds(), 10)
+		}
+		fmt.Println(
+			i,
+			r.Client,
+			r.Height,
+			r.Duration.Milliseconds(),
+			r.SinceCommit.Milliseconds(),
+			r.Err == nil,
+			strings.Join(shares, ","),
+		)
+	}
+	fmt.Println("data-end----------------")
+	fmt.Println(summarize(results))
+	return nil
+}
+
+// Summary aggregates the success rate and latencies of a set of samples. The
+// latencies only include successful samples.
+type Summary struct {
+	Total     int
+	Succeeded int
+	Min       time.Duration
+	Median    time.Duration
+	Mean      time.Duration
+	P95       time.Duration
+	Max       time.Duration
+}
+
+func summarize(results []SampleResult) Summary {
+	sum := Summary{Total: len(results)}
+	durations := make([]time.Duration, 0, len(results))
+	var total time.Duration
+	for _, r := range results {
+		if r.Err != nil {
+			continue
+		}
+		durations = append(durations, r.Duration)
+		total += r.Duration
+	}
+	sum.Succeeded = len(durations)
+	if len(durations) == 0 {
+		return sum
+	}
+
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	sum.Min = durations[0]
+	sum.Max = durations[len(durations)-1]
+	sum.Median = durations[len(durations)/2]
+	sum.P95 = durations[(len(durations)*95-1)/100]
+	sum.Mean = total / time.Duration(len(durations))
+	return sum
+}
+
+// SuccessRate returns the fraction of samples that succeeded
+func (s Summary) SuccessRate() float64 {
+	if s.Total == 0 {
+		return 0
+	}
+	return float64(s.Succeeded) / float64(s.Total)
+}
+
+func (s Summary) String() string {
+	return fmt.Sprintf(
+		"#SUMMARY samples=%d succeeded=%d success-rate=%.4f min=%dms median=%dms mean=%dms p95=%dms max=%dms",
+		s.Total,
+		s.Succeeded,
+		s.SuccessRate(),
+		s.Min.Milliseconds(),
+		s.Median.Milliseconds(),
+		s.Mean.Milliseconds(),
+		s.P95.Milliseconds(),
+		s.Max.Milliseconds(),
+	)
+}
+
+// validateOut checks that the format of the output file is supported, so that
+// a typo is caught before any work is done. An empty path is valid.
+func validateOut(path string) error {
+	if path == "" {
+		return nil
+	}
+	switch ext := filepath.Ext(path); ext {
+	case ".json", ".jsonl", ".csv":
+		return nil
+	default:
+		return fmt.Errorf("unsupported output format %q, use .json, .jsonl or .csv", ext)
+	}
+}
+
+// writeResults writes the results to path using the format indicated by its
+// extension: .json, .jsonl or .csv
+func writeResults(path string, results []SampleResult) error {
+	records := make([]csvRecord, len(results))
+	for i, r := range results {
+		records[i] = newRecord(r)
+	}
+	return writeRecords(path, csvHeader, records)
+}
+
+// csvRecord is a record that can also be written as a csv row
+type csvRecord interface {
+	csv() []string
+}
+
+// writeRecords writes the records to path using the format indicated by its
+// extension: .json, .jsonl or .csv. header is only used for csv.
+func writeRecords(path string, header []string, records []csvRecord) error {
+	err := validateOut(path)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	switch filepath.Ext(path) {
+	case ".json":
+		enc := json.NewEncoder(file)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(records)
+	case ".jsonl":
+		enc := json.NewEncoder(file)
+		for _, rec := range records {
+			if err = enc.Encode(rec); err != nil {
+				break
+			}
+		}
+	case ".csv":
+		w := csv.NewWriter(file)
+		err = w.Write(header)
+		for _, rec := range records {
+			if err != nil {
+				break
+			}
+			err = w.Write(rec.csv())
+		}
+		w.Flush()
+		if err == nil {
+			err = w.Error()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
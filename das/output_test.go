@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateOut(t *testing.T) {
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{path: ""},
+		{path: "results.json"},
+		{path: "results.jsonl"},
+		{path: "runs/1/results.csv"},
+		{path: "results.txt", wantErr: true},
+		{path: "results", wantErr: true},
+		{path: "results.JSON", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			err := validateOut(tt.path)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
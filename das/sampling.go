@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/lazyledger/lazyledger-core/ipfs"
@@ -13,13 +17,24 @@ import (
 	ctypes "github.com/lazyledger/lazyledger-core/rpc/core/types"
 	tmclient "github.com/lazyledger/lazyledger-core/rpc/jsonrpc/client"
 	"github.com/lazyledger/lazyledger-core/types"
-	"github.com/lazyledger/nmt/namespace"
 	"github.com/spf13/cobra"
 )
 
 func sampleCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:     "sample",
+	var (
+		follow        bool
+		pollInterval  time.Duration
+		numSamples    int
+		heights       string
+		randomHeights int
+		concurrency   int
+		rate          float64
+		timeout       time.Duration
+		instrument    bool
+		out           string
+	)
+	cmd := &cobra.Command{
+		Use:     "sample [host] [iterations]",
 		Aliases: []string{"sample", "s"},
 		Args:    cobra.MinimumNArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -30,76 +45,391 @@ func sampleCmd() *cobra.Command {
 				return err
 			}
 
-			times, err := Sample(cmd.Context(), host, int(iterations))
+			if err := validateSamples(numSamples); err != nil {
+				return err
+			}
+			if err := validateOut(out); err != nil {
+				return err
+			}
+			if follow && (heights != "" || randomHeights != 0) {
+				return errors.New("--follow samples new blocks and can't be combined with --heights or --random-heights")
+			}
+			if follow && (cmd.Flags().Changed("concurrency") || cmd.Flags().Changed("rate")) {
+				return errors.New("--follow samples each block as it is committed and can't be combined with --concurrency or --rate")
+			}
+
+			parsedHeights, err := parseHeights(heights)
 			if err != nil {
 				return err
 			}
 
-			// easy improvement would be to save the times as a file instead of
-			// pushing them to Stdout (eventually to a local log files)
-			fmt.Println("data-start--------------")
-			for i, t := range times {
-				fmt.Println(i, t.Milliseconds())
+			opts := SampleOptions{
+				Iterations:    int(iterations),
+				NumSamples:    numSamples,
+				Heights:       parsedHeights,
+				RandomHeights: randomHeights,
+				Concurrency:   concurrency,
+				Rate:          rate,
+				Timeout:       timeout,
+				PollInterval:  pollInterval,
+				Instrument:    instrument,
+				Quiet:         out != "",
+			}
+
+			var results []SampleResult
+			if follow {
+				results, err = Follow(cmd.Context(), host, opts)
+			} else {
+				results, err = Sample(cmd.Context(), host, opts)
+			}
+
+			// report whatever was sampled before any failure
+			if reportErr := report(results, out); reportErr != nil {
+				return reportErr
 			}
-			fmt.Println("data-end----------------")
-			return nil
+			return err
 		},
 	}
+	cmd.Flags().BoolVar(
+		&follow,
+		"follow",
+		false,
+		"sample each new block once as it is committed instead of sampling the latest block repeatedly. iterations is the number of blocks to sample",
+	)
+	cmd.Flags().DurationVar(
+		&pollInterval,
+		"poll-interval",
+		time.Second,
+		"how often to check for new blocks when following the chain",
+	)
+	cmd.Flags().IntVar(
+		&numSamples,
+		"samples",
+		1,
+		"number of shares sampled from each block",
+	)
+	cmd.Flags().StringVar(
+		&heights,
+		"heights",
+		"",
+		"comma separated heights or height ranges to sample instead of the latest block, ie 100-200. iterations is the number of times each height is sampled",
+	)
+	cmd.Flags().IntVar(
+		&randomHeights,
+		"random-heights",
+		0,
+		"number of random heights between 1 and the latest height to sample instead of the latest block. iterations is the number of times each height is sampled",
+	)
+	cmd.Flags().IntVar(
+		&concurrency,
+		"concurrency",
+		1,
+		"number of goroutines sampling concurrently using the same IPFS node",
+	)
+	cmd.Flags().Float64Var(
+		&rate,
+		"rate",
+		0,
+		"maximum number of blocks sampled per second across all goroutines. 0 means unlimited",
+	)
+	cmd.Flags().DurationVar(&timeout, "timeout", ipld.ValidationTimeout, timeoutUsage)
+	cmd.Flags().BoolVar(&instrument, "instrument", false, instrumentUsage)
+	cmd.Flags().StringVar(&out, "out", "", outUsage)
+	return cmd
+}
+
+// SampleOptions configures which blocks are sampled and how
+type SampleOptions struct {
+	// Iterations is the number of times each block is sampled
+	Iterations int
+	// NumSamples is the number of shares sampled from each block
+	NumSamples int
+	// Heights are the heights of the blocks that are sampled. The latest
+	// block is sampled if no heights are provided.
+	Heights []int64
+	// RandomHeights is the number of random heights between 1 and the latest
+	// height that are sampled in addition to Heights
+	RandomHeights int
+	// Concurrency is the number of goroutines sampling at the same time
+	Concurrency int
+	// Rate is the maximum number of blocks sampled per second, or unlimited
+	// if 0
+	Rate float64
+	// Timeout is the maximum time spent on a single sample before it is
+	// recorded as failed
+	Timeout time.Duration
+	// PollInterval is how often to check for new blocks when following the
+	// chain
+	PollInterval time.Duration
+	// Instrument records the change in the node wide DHT, connection and
+	// bitswap counters during each sample
+	Instrument bool
+	// Quiet doesn't print the #DATA lines of each sample, ie because the
+	// results are written to a file
+	Quiet bool
 }
 
-func Sample(ctx context.Context, host string, iterations int) ([]time.Duration, error) {
-	logger := log.NewTMLogger(log.NewSyncWriter(os.Stdout))
+// sampleJob is a single sample of the block at height
+type sampleJob struct {
+	height int64
+	dah    *types.DataAvailabilityHeader
+}
 
-	apiProvider := ipfs.Embedded(false, ipfs.DefaultConfig(), logger)
+// Sample samples the blocks described by opts using the embedded IPFS node.
+// Failed samples are recorded in the results instead of aborting the run.
+func Sample(ctx context.Context, host string, opts SampleOptions) ([]SampleResult, error) {
+	logger := log.NewTMLogger(log.NewSyncWriter(os.Stderr))
 
-	dag, cls, err := apiProvider()
+	node, err := startNode(ipfs.Embedded(false, ipfs.DefaultConfig(), logger))
 	if err != nil {
-		fmt.Println(err, 2)
-		os.Exit(1)
+		return nil, fmt.Errorf("failure to start the IPFS node: %w", err)
 	}
-	defer cls.Close()
+	defer node.Close()
 
 	client, err := tmclient.New("tcp://" + host)
 	if err != nil {
-		fmt.Println(err, 1)
-		os.Exit(1)
+		return nil, fmt.Errorf("failure to create the RPC client: %w", err)
 	}
 
-	dah, err := getLatestDAH(ctx, client)
+	return sampleNode(ctx, node, client, opts, 0)
+}
+
+// sampleNode samples the blocks described by opts using the provided IPFS
+// node. client is the index of the light client identity the node belongs to.
+func sampleNode(
+	ctx context.Context,
+	node lightNode,
+	rpc *tmclient.Client,
+	opts SampleOptions,
+	client int,
+) ([]SampleResult, error) {
+	heights, err := sampleHeights(ctx, rpc, opts)
 	if err != nil {
-		fmt.Println(err, 3)
-		os.Exit(1)
+		return nil, fmt.Errorf("failure to get the heights to sample: %w", err)
 	}
 
-	sampleTimes := make([]time.Duration, iterations)
-	for i := 0; i < iterations; i++ {
-		start := time.Now()
-		err = ipld.ValidateAvailability(ctx, dag, &dah, 1, func(pd namespace.PrefixedData8) {})
+	// fetch every DAH up front so that the RPC calls don't interfere with
+	// the sampling. Heights whose DAH can't be fetched are recorded as failed.
+	jobs := make([]sampleJob, 0, len(heights)*opts.Iterations)
+	results := make([]SampleResult, 0, len(heights)*opts.Iterations)
+	for _, height := range heights {
+		dah, err := getDAH(ctx, rpc, height)
 		if err != nil {
-			fmt.Println(err, 4)
-			os.Exit(1)
+			result := SampleResult{
+				Timestamp: time.Now(),
+				Client:    client,
+				Index:     len(results),
+				Height:    height,
+				Peers:     node.Peers(),
+				Err:       fmt.Errorf("failure to get the DAH: %w", err),
+			}
+			if !opts.Quiet {
+				printSample("sample", result.Index, result)
+			}
+			results = append(results, result)
+			continue
 		}
-		end := time.Now()
-		total := end.Sub(start)
-		fmt.Printf("#DATA sample %d %dms\n", i, total.Milliseconds())
-		sampleTimes[i] = total
-		time.Sleep(20)
+		for i := 0; i < opts.Iterations; i++ {
+			jobs = append(jobs, sampleJob{height: height, dah: &dah})
+		}
+	}
+
+	workers := opts.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	var (
+		mut   sync.Mutex
+		wg    sync.WaitGroup
+		queue = dispatch(ctx, jobs, opts.Rate)
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				var inst *instrumentation
+				if opts.Instrument {
+					inst = node.startInstrumentation()
+				}
+				// failed samples are kept, as they are part of the results
+				result, _ := sampleBlockShares(ctx, node, job.height, job.dah, opts.NumSamples, opts.Timeout)
+				if inst != nil {
+					result.Instrumentation = inst.stop()
+				}
+				mut.Lock()
+				result.Client = client
+				result.Index = len(results)
+				result.Peers = node.Peers()
+				if !opts.Quiet {
+					printSample("sample", result.Index, result)
+				}
+				results = append(results, result)
+				mut.Unlock()
+			}
+		}()
 	}
+	wg.Wait()
 
-	return sampleTimes, nil
+	return results, ctx.Err()
 }
 
-func getLatestDAH(ctx context.Context, client *tmclient.Client) (types.DataAvailabilityHeader, error) {
-	height, err := getLatestHeight(ctx, client)
-	if err != nil {
-		return types.DataAvailabilityHeader{}, err
+// dispatch sends each job over the returned channel, waiting between jobs to
+// stay below rate jobs per second if rate is positive
+func dispatch(ctx context.Context, jobs []sampleJob, rate float64) <-chan sampleJob {
+	queue := make(chan sampleJob)
+	go func() {
+		defer close(queue)
+		var tick <-chan time.Time
+		if rate > 0 {
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for i, job := range jobs {
+			if tick != nil && i > 0 {
+				select {
+				case <-tick:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case queue <- job:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return queue
+}
+
+// sampleHeights returns the heights of the blocks to sample
+func sampleHeights(ctx context.Context, client *tmclient.Client, opts SampleOptions) ([]int64, error) {
+	if len(opts.Heights) == 0 && opts.RandomHeights == 0 {
+		height, err := getLatestHeight(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+		return []int64{height}, nil
+	}
+
+	heights := append([]int64{}, opts.Heights...)
+	if opts.RandomHeights > 0 {
+		latest, err := getLatestHeight(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+		heights = append(heights, randomHeights(opts.RandomHeights, latest)...)
+	}
+	return heights, nil
+}
+
+// randomHeights returns up to count unique random heights between 1 and
+// latest
+func randomHeights(count int, latest int64) []int64 {
+	if int64(count) > latest {
+		count = int(latest)
+	}
+	picked := make(map[int64]struct{}, count)
+	heights := make([]int64, 0, count)
+	for len(heights) < count {
+		height := rand.Int63n(latest) + 1
+		if _, has := picked[height]; has {
+			continue
+		}
+		picked[height] = struct{}{}
+		heights = append(heights, height)
+	}
+	return heights
+}
+
+// validateSamples checks the number of shares sampled from each block, which
+// can only be checked against the square's size once the block is fetched
+func validateSamples(numSamples int) error {
+	if numSamples < 1 {
+		return fmt.Errorf("--samples must be at least 1, got %d", numSamples)
+	}
+	return nil
+}
+
+// maxHeights is the number of heights that can be passed using --heights, so
+// that a mistyped range doesn't allocate every height of the chain
+const maxHeights = 100000
+
+// parseHeights parses a comma separated list of heights and inclusive height
+// ranges, ie "5,100-200"
+func parseHeights(raw string) ([]int64, error) {
+	var heights []int64
+	if raw == "" {
+		return heights, nil
+	}
+	for _, part := range strings.Split(raw, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		start, err := strconv.ParseInt(bounds[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid height %q: %w", part, err)
+		}
+		end := start
+		if len(bounds) == 2 {
+			end, err = strconv.ParseInt(bounds[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid height range %q: %w", part, err)
+			}
+		}
+		if start < 1 || end < start {
+			return nil, fmt.Errorf("invalid height range %q", part)
+		}
+		if end-start+1 > maxHeights-int64(len(heights)) {
+			return nil, fmt.Errorf("too many heights in %q, at most %d can be sampled", raw, maxHeights)
+		}
+		for height := start; height <= end; height++ {
+			heights = append(heights, height)
+		}
+	}
+	return heights, nil
+}
+
+// printSample prints the total time of a sample followed by the retrieval
+// time of each of its shares
+func printSample(label string, i int, r SampleResult) {
+	fmt.Printf(
+		"#DATA %s %d client=%d height=%d %dms since-commit=%dms samples=%d confidence=%.6f\n",
+		label,
+		i,
+		r.Client,
+		r.Height,
+		r.Duration.Milliseconds(),
+		r.SinceCommit.Milliseconds(),
+		len(r.Shares),
+		r.Confidence,
+	)
+	if r.Err != nil {
+		fmt.Printf("#DATA %s %d failed: %v\n", label, i, r.Err)
+	}
+	if in := r.Instrumentation; in != nil {
+		fmt.Printf(
+			"#DATA instrument %d node-lookups=%d node-queries=%d node-providers=%d first-provider=%s node-dialed=%d node-blocks=%d node-bytes=%d overlapped=%t\n",
+			i,
+			in.NodeProviderLookups,
+			in.NodeDHTQueries,
+			in.NodeProvidersFound,
+			in.TimeToFirstProvider,
+			in.NodePeersDialed,
+			in.NodeBlocksReceived,
+			in.NodeBytesReceived,
+			in.Overlapped,
+		)
+	}
+	for _, s := range r.Shares {
+		fmt.Printf("#DATA share %d row=%d col=%d %dms\n", i, s.Row, s.Col, s.Duration.Milliseconds())
 	}
-	return getDAH(ctx, client, height)
 }
 
 func getDAH(ctx context.Context, client *tmclient.Client, height int64) (types.DataAvailabilityHeader, error) {
 	var dah ctypes.ResultDataAvailabilityHeader
-	_, err := client.Call(context.Background(), "data_availability_header", map[string]interface{}{"height": height}, &dah)
+	_, err := client.Call(ctx, "data_availability_header", map[string]interface{}{"height": height}, &dah)
 	if err != nil {
 		return types.DataAvailabilityHeader{}, err
 	}
@@ -108,7 +438,7 @@ func getDAH(ctx context.Context, client *tmclient.Client, height int64) (types.D
 
 func getLatestHeight(ctx context.Context, client *tmclient.Client) (int64, error) {
 	var res ctypes.ResultBlockchainInfo
-	_, err := client.Call(context.Background(), "blockchain", map[string]interface{}{}, &res)
+	_, err := client.Call(ctx, "blockchain", map[string]interface{}{}, &res)
 	if err != nil {
 		return 0, err
 	}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHeights(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    []int64
+		wantErr bool
+	}{
+		{name: "empty", raw: "", want: nil},
+		{name: "single", raw: "5", want: []int64{5}},
+		{name: "list", raw: "5,7,9", want: []int64{5, 7, 9}},
+		{name: "spaces", raw: " 5, 7 ", want: []int64{5, 7}},
+		{name: "range", raw: "3-6", want: []int64{3, 4, 5, 6}},
+		{name: "single height range", raw: "4-4", want: []int64{4}},
+		{name: "list and range", raw: "1,10-12", want: []int64{1, 10, 11, 12}},
+		// duplicates are sampled once per occurrence
+		{name: "duplicates", raw: "2,2,1-2", want: []int64{2, 2, 1, 2}},
+		{name: "zero", raw: "0", wantErr: true},
+		{name: "negative", raw: "-3", wantErr: true},
+		{name: "reversed range", raw: "6-3", wantErr: true},
+		{name: "open range", raw: "3-", wantErr: true},
+		{name: "not a number", raw: "abc", wantErr: true},
+		{name: "empty element", raw: "1,,2", wantErr: true},
+		{name: "max heights", raw: "1-100000", want: heightRange(1, maxHeights)},
+		{name: "unbounded range", raw: "1-1000000000", wantErr: true},
+		{name: "too many heights", raw: "5,1-100000", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHeights(tt.raw)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func heightRange(start, end int64) []int64 {
+	heights := make([]int64, 0, end-start+1)
+	for height := start; height <= end; height++ {
+		heights = append(heights, height)
+	}
+	return heights
+}
+
+func TestValidateSamples(t *testing.T) {
+	tests := []struct {
+		numSamples int
+		wantErr    bool
+	}{
+		{numSamples: 1},
+		{numSamples: 16},
+		{numSamples: 0, wantErr: true},
+		{numSamples: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.numSamples), func(t *testing.T) {
+			err := validateSamples(tt.numSamples)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestRandomHeights(t *testing.T) {
+	heights := randomHeights(10, 5)
+	require.Len(t, heights, 5)
+	seen := make(map[int64]struct{})
+	for _, h := range heights {
+		require.True(t, h >= 1 && h <= 5, "height %d out of range", h)
+		_, dup := seen[h]
+		require.False(t, dup, "duplicate height %d", h)
+		seen[h] = struct{}{}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/lazyledger/lazyledger-core/p2p/ipld"
+	"github.com/lazyledger/lazyledger-core/types"
+)
+
+// SampleResult is the result of sampling a block once
+type SampleResult struct {
+	// Timestamp is when the sample started
+	Timestamp time.Time
+	// Client is the index of the light client identity that took the
+	// sample. It is always 0 outside of a swarm.
+	Client int
+	// Index is the position of the sample among the samples taken by the
+	// client
+	Index   int
+	Height  int64
+	DAHHash []byte
+	// Duration is the total time spent sampling the block
+	Duration time.Duration
+	// SinceCommit is the time from the block's commit until the sample
+	// succeeded. It is only recorded when following the chain.
+	SinceCommit time.Duration
+	// Shares contains the retrieval of each sampled share
+	Shares []ShareSample
+	// Confidence is the probability that the block is available given that
+	// each sampled share was retrieved
+	Confidence float64
+	// Peers is the number of peers the IPFS node was connected to once the
+	// sample finished, or -1 if unknown
+	Peers int
+	// Err is the reason the sample failed, if it did
+	Err error
+	// Instrumentation is the change in the node wide counters during the
+	// sample. It is nil unless instrumentation is enabled.
+	Instrumentation *Instrumentation
+}
+
+// ShareSample is the retrieval of a single share
+type ShareSample struct {
+	Row, Col uint32
+	Duration time.Duration
+}
+
+// sampleBlockShares randomly samples numSamples shares from the block
+// described by dah. Like ipld.ValidateAvailability, it only succeeds once
+// every share has been retrieved, but it also records how long each
+// retrieval took. The returned result records the failure if the shares
+// could not be retrieved within timeout.
+func sampleBlockShares(
+	ctx context.Context,
+	dag format.NodeGetter,
+	height int64,
+	dah *types.DataAvailabilityHeader,
+	numSamples int,
+	timeout time.Duration,
+) (SampleResult, error) {
+	if timeout <= 0 {
+		timeout = ipld.ValidationTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	result := SampleResult{
+		Timestamp: start,
+		Height:    height,
+		DAHHash:   dah.Hash(),
+		Shares:    make([]ShareSample, 0, numSamples),
+	}
+	fail := func(err error) (SampleResult, error) {
+		result.Duration = time.Since(start)
+		result.Err = err
+		return result, err
+	}
+
+	squareWidth := uint32(len(dah.ColumnRoots))
+	if numSamples < 1 || numSamples > int(squareWidth*squareWidth) {
+		return fail(fmt.Errorf(
+			"cannot take %d samples from a %dx%d square", numSamples, squareWidth, squareWidth,
+		))
+	}
+	samples := ipld.SampleSquare(squareWidth, numSamples)
+
+	type res struct {
+		share ShareSample
+		err   error
+	}
+	resCh := make(chan res, len(samples))
+	for _, s := range samples {
+		go func(s ipld.Sample) {
+			shareStart := time.Now()
+			root, leaf, err := s.Leaf(dah)
+			if err == nil {
+				_, err = ipld.GetLeafData(ctx, root, leaf, squareWidth, dag)
+			}
+			select {
+			case resCh <- res{
+				share: ShareSample{Row: s.Row, Col: s.Col, Duration: time.Since(shareStart)},
+				err:   err,
+			}:
+			case <-ctx.Done():
+			}
+		}(s)
+	}
+
+	for range samples {
+		select {
+		case r := <-resCh:
+			if r.err != nil {
+				if errors.Is(r.err, format.ErrNotFound) {
+					return fail(ipld.ErrValidationFailed)
+				}
+				return fail(r.err)
+			}
+			result.Shares = append(result.Shares, r.share)
+		case <-ctx.Done():
+			err := ctx.Err()
+			if err == context.DeadlineExceeded {
+				return fail(fmt.Errorf("%v: %w", ipld.ErrValidationFailed, err))
+			}
+			return fail(err)
+		}
+	}
+
+	result.Duration = time.Since(start)
+	result.Confidence = confidence(squareWidth, len(samples))
+	return result, nil
+}
+
+// confidence returns the probability that a block is available after
+// successfully retrieving the given number of unique samples from its
+// extended square. An unrecoverable block must withhold at least (k+1)^2 of
+// the (2k)^2 shares, so each successful sample has at most a
+// 1-((k+1)/2k)^2 chance of missing the withheld shares.
+func confidence(squareWidth uint32, samples int) float64 {
+	if squareWidth < 2 {
+		return 0
+	}
+	k := float64(squareWidth) / 2
+	miss := 1 - math.Pow((k+1)/(2*k), 2)
+	return 1 - math.Pow(miss, float64(samples))
+}
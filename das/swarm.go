@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lazyledger/lazyledger-core/libs/log"
+	"github.com/lazyledger/lazyledger-core/p2p/ipld"
+	tmclient "github.com/lazyledger/lazyledger-core/rpc/jsonrpc/client"
+	"github.com/spf13/cobra"
+)
+
+func swarmCmd() *cobra.Command {
+	var (
+		clients         int
+		repoRoot        string
+		bootstrapConfig string
+		swarmPort       int
+		numSamples      int
+		timeout         time.Duration
+		instrument      bool
+		out             string
+	)
+	cmd := &cobra.Command{
+		Use:     "swarm [host] [iterations]",
+		Aliases: []string{"swarm"},
+		Args:    cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			host := args[0]
+
+			iterations, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				return err
+			}
+			if err := validateSamples(numSamples); err != nil {
+				return err
+			}
+			if err := validateOut(out); err != nil {
+				return err
+			}
+
+			var bootstrap []string
+			if bootstrapConfig != "" {
+				bootstrap, err = readBootstrap(bootstrapConfig)
+				if err != nil {
+					return err
+				}
+			}
+
+			results, err := Swarm(cmd.Context(), host, SwarmOptions{
+				Clients:   clients,
+				RepoRoot:  repoRoot,
+				Bootstrap: bootstrap,
+				SwarmPort: swarmPort,
+				Sample: SampleOptions{
+					Iterations: int(iterations),
+					NumSamples: numSamples,
+					Timeout:    timeout,
+					Instrument: instrument,
+					Quiet:      out != "",
+				},
+			})
+
+			// report whatever was sampled before any failure
+			if reportErr := report(results, out); reportErr != nil {
+				return reportErr
+			}
+			return err
+		},
+	}
+	cmd.Flags().IntVar(&clients, "clients", 1, "number of light clients, each with its own IPFS node and peer ID")
+	cmd.Flags().StringVar(&repoRoot, "repo-root", "ipfs-swarm", "directory containing the IPFS repo of each light client")
+	cmd.Flags().StringVar(
+		&bootstrapConfig,
+		"bootstrap-config",
+		"",
+		"path to an IPFS config whose bootstrap peers are used by every light client, ie the one updated by add-hydra",
+	)
+	cmd.Flags().IntVar(
+		&swarmPort,
+		"swarm-port",
+		0,
+		"tcp port of the first light client, incremented for each following client. Random ports are used if 0",
+	)
+	cmd.Flags().IntVar(&numSamples, "samples", 1, "number of shares sampled from each block")
+	cmd.Flags().DurationVar(&timeout, "timeout", ipld.ValidationTimeout, timeoutUsage)
+	cmd.Flags().BoolVar(&instrument, "instrument", false, instrumentUsage)
+	cmd.Flags().StringVar(&out, "out", "", outUsage)
+	return cmd
+}
+
+// SwarmOptions configures a swarm of light clients
+type SwarmOptions struct {
+	// Clients is the number of light clients in the swarm
+	Clients int
+	// RepoRoot is the directory containing the IPFS repo of each client
+	RepoRoot string
+	// Bootstrap replaces the default bootstrap peers of each client if not
+	// nil
+	Bootstrap []string
+	// SwarmPort is the port of the first client, or 0 for random ports
+	SwarmPort int
+	// Sample configures how each client samples
+	Sample SampleOptions
+}
+
+// Swarm starts the configured number of embedded IPFS nodes, each with their
+// own repo and peer ID, and has each of them sample independently
+func Swarm(ctx context.Context, host string, opts SwarmOptions) ([]SampleResult, error) {
+	logger := log.NewTMLogger(log.NewSyncWriter(os.Stderr))
+
+	rpc, err := tmclient.New("tcp://" + host)
+	if err != nil {
+		return nil, fmt.Errorf("failure to create the RPC client: %w", err)
+	}
+
+	// start the nodes one by one, as starting an embedded node modifies the
+	// process' environment
+	nodes := make([]lightNode, 0, opts.Clients)
+	defer func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	}()
+	for i := 0; i < opts.Clients; i++ {
+		port := 0
+		if opts.SwarmPort != 0 {
+			port = opts.SwarmPort + i
+		}
+		node, err := newEmbeddedNode(
+			filepath.Join(opts.RepoRoot, fmt.Sprintf("client-%d", i)),
+			repoOptions{SwarmPort: port, Bootstrap: opts.Bootstrap},
+			logger.With("client", i),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failure to start light client %d: %w", i, err)
+		}
+		nodes = append(nodes, node)
+	}
+
+	var (
+		mut      sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+		results  []SampleResult
+	)
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(client int, node lightNode) {
+			defer wg.Done()
+			res, err := sampleNode(ctx, node, rpc, opts.Sample, client)
+			mut.Lock()
+			defer mut.Unlock()
+			results = append(results, res...)
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("light client %d: %w", client, err)
+			}
+		}(i, node)
+	}
+	wg.Wait()
+
+	return results, firstErr
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/evan-forbes/devnet/config"
+	"golang.org/x/crypto/ssh"
+)
+
+// detachedDir is the directory in which the output and the exit status of
+// detached commands are kept. $HOME is expanded by the remote shell, so that
+// the paths don't depend on the working directory of the command.
+const detachedDir = "$HOME/.devnet"
+
+// runCommand runs the command on the droplet, detached from the ssh
+// connection if the config says so
+func runCommand(conf config.Config, c Connection, command string) error {
+	if !conf.DetachCommands {
+		return c.Run(command)
+	}
+	giveUp, err := conf.KeepAlive.GiveUpDuration()
+	if err != nil {
+		return err
+	}
+	return c.RunDetached(command, giveUp)
+}
+
+// RunDetached starts the command in the background of the droplet, so that it
+// keeps running if the ssh connection is lost, and follows its output into
+// the local client's output file until it exits. The output is followed
+// again from where it was left once the connection is re-established, unless
+// the droplet couldn't be reached for longer than giveUp.
+func (c Connection) RunDetached(command string, giveUp time.Duration) error {
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+	logPath := path.Join(detachedDir, id+".log")
+	exitPath := path.Join(detachedDir, id+".exit")
+
+	// the trap records the exit status even if the command calls exit
+	script := fmt.Sprintf("trap 'echo $? > \"%s\"' EXIT\n%s", exitPath, command)
+	out, err := c.Output(fmt.Sprintf(
+		"mkdir -p \"%s\"; nohup bash -c %s > \"%s\" 2>&1 < /dev/null & echo $!",
+		detachedDir,
+		shellQuote(script),
+		logPath,
+	))
+	if err != nil {
+		return fmt.Errorf("failure to start detached command: %w", err)
+	}
+	pid := strings.TrimSpace(string(out))
+	err = c.Event("detached %q as pid %s, logging to %s", command, pid, logPath)
+	if err != nil {
+		return err
+	}
+
+	var (
+		offset  int64
+		backoff = time.Second
+		// lost is when the droplet was last reached before following the
+		// output started failing
+		lost = time.Now()
+	)
+	for {
+		n, reached, err := c.follow(logPath, pid, offset)
+		offset += n
+		if reached {
+			lost = time.Now()
+		}
+		if err == nil {
+			var status []byte
+			status, err = c.Output(fmt.Sprintf("cat \"%s\" 2>/dev/null; true", exitPath))
+			if err == nil {
+				return exitStatus(strings.TrimSpace(string(status)))
+			}
+		}
+
+		// the command itself failed, as opposed to the connection
+		var exit *ssh.ExitError
+		if errors.As(err, &exit) || c.client.Closed() {
+			return err
+		}
+		if time.Since(lost) > giveUp {
+			return fmt.Errorf("failure to follow output of %s, %s unreachable for %s: %w", command, c.drop.Drop.Name, giveUp, err)
+		}
+		log.Println(fmt.Errorf("lost output of %s on %s, following it again in %s: %w", command, c.drop.Drop.Name, backoff, err))
+		time.Sleep(backoff)
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// follow writes the output of the detached command from offset, in bytes,
+// until the process exits, returning the number of bytes written. reached is
+// false if the droplet couldn't be reached to start following.
+func (c Connection) follow(logPath, pid string, offset int64) (n int64, reached bool, err error) {
+	sesh, err := c.NewSession()
+	if err != nil {
+		return 0, false, err
+	}
+	defer sesh.Close()
+
+	counter := &countingWriter{w: c.output}
+	sesh.Stdout = counter
+	err = sesh.Run(fmt.Sprintf("tail -c +%d --pid=%s -F \"%s\" 2>/dev/null", offset+1, pid, logPath))
+	return counter.n, true, err
+}
+
+// exitStatus converts the recorded exit status of a detached command into an
+// error, which is empty if the process was killed before it could record it
+func exitStatus(status string) error {
+	switch status {
+	case "0":
+		return nil
+	case "":
+		return errors.New("detached command was killed")
+	default:
+		return fmt.Errorf("detached command exited with status %s", status)
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// shellQuote quotes s as a single argument of a posix shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
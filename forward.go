@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/evan-forbes/devnet/config"
+	"github.com/spf13/cobra"
+)
+
+func ForwardCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:     "forward [config-path] [droplet] [remote-port[:local-port]...]",
+		Aliases: []string{"forward", "f"},
+		Short:   "forward ports on a droplet's localhost to local ports until interrupted",
+		Long:    "forward ports on a droplet's localhost to local ports until interrupted. The droplet's configured forwards are used if no ports are provided.",
+		Args:    cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			conf, manager, err := connect(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			defer manager.CloseAll()
+
+			name := args[1]
+			drop, has := conf.Droplets[name]
+			if !has {
+				return fmt.Errorf("droplet not found in config: %s", name)
+			}
+			specs := args[2:]
+			if len(specs) == 0 {
+				specs = drop.Forwards
+			}
+			if len(specs) == 0 {
+				return fmt.Errorf("no ports to forward for %s", name)
+			}
+			if err, skipped := manager.Unreachable[name]; skipped {
+				return fmt.Errorf("failure to connect to droplet %s: %w", name, err)
+			}
+
+			tunnels, err := openTunnels(manager, map[string][]string{name: specs})
+			if err != nil {
+				return err
+			}
+			defer tunnels.Close()
+
+			// the forwards are kept with the run they are used alongside,
+			// without replacing the ones opened by init
+			runDir, err := latestRunDir(conf)
+			if err != nil {
+				return err
+			}
+			err = tunnels.Save(filepath.Join(runDir, fmt.Sprintf("forwards-%s.json", name)))
+			if err != nil {
+				return err
+			}
+			tunnels.Print()
+
+			interrupt := make(chan os.Signal, 1)
+			signal.Notify(interrupt, os.Interrupt)
+			defer signal.Stop(interrupt)
+			select {
+			case <-interrupt:
+			case <-cmd.Context().Done():
+			}
+			return nil
+		},
+	}
+}
+
+// Forward is a local port whose connections are forwarded to a port on a
+// droplet's localhost through the droplet's ssh connection
+type Forward struct {
+	Droplet    string `json:"droplet"`
+	RemotePort int    `json:"remote_port"`
+	LocalPort  int    `json:"local_port"`
+
+	listener net.Listener
+	done     chan struct{}
+}
+
+// Close stops accepting connections
+func (f *Forward) Close() error {
+	close(f.done)
+	return f.listener.Close()
+}
+
+// Tunnels holds every open forward
+type Tunnels struct {
+	Forwards []*Forward
+}
+
+// openTunnels opens each forward, keyed by the name of the droplet. Any
+// opened forwards are closed if one of them fails. The forwards of the
+// droplets that were skipped as unreachable are ignored.
+func openTunnels(manager *SSHManager, specs map[string][]string) (*Tunnels, error) {
+	tunnels := &Tunnels{}
+	for name, droplet := range specs {
+		if _, skipped := manager.Unreachable[name]; skipped {
+			continue
+		}
+		conn, has := manager.Conns[name]
+		if !has {
+			tunnels.Close()
+			return nil, fmt.Errorf("no connection to droplet %s", name)
+		}
+		for _, spec := range droplet {
+			remote, local, err := config.ParseForward(spec)
+			if err != nil {
+				tunnels.Close()
+				return nil, err
+			}
+			forward, err := conn.Forward(name, remote, local)
+			if err != nil {
+				tunnels.Close()
+				return nil, fmt.Errorf("failure to forward port %d of %s: %w", remote, name, err)
+			}
+			tunnels.Forwards = append(tunnels.Forwards, forward)
+		}
+	}
+	sort.Slice(tunnels.Forwards, func(i, j int) bool {
+		a, b := tunnels.Forwards[i], tunnels.Forwards[j]
+		if a.Droplet != b.Droplet {
+			return a.Droplet < b.Droplet
+		}
+		return a.RemotePort < b.RemotePort
+	})
+	return tunnels, nil
+}
+
+// configuredForwards returns the configured forwards of each droplet
+func configuredForwards(conf config.Config) map[string][]string {
+	specs := make(map[string][]string)
+	for name, drop := range conf.Droplets {
+		if len(drop.Forwards) > 0 {
+			specs[name] = drop.Forwards
+		}
+	}
+	return specs
+}
+
+// Print prints the local port of each forward
+func (t *Tunnels) Print() {
+	for _, f := range t.Forwards {
+		fmt.Printf("forwarding 127.0.0.1:%d to %s:%d\n", f.LocalPort, f.Droplet, f.RemotePort)
+	}
+}
+
+// Save writes the local port of each forward to a json file at path
+func (t *Tunnels) Save(path string) error {
+	data, err := json.MarshalIndent(t.Forwards, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Close stops accepting connections on each forward
+func (t *Tunnels) Close() {
+	for _, f := range t.Forwards {
+		err := f.Close()
+		if err != nil {
+			log.Println(fmt.Errorf("failure to close forward of %s:%d: %w", f.Droplet, f.RemotePort, err))
+		}
+	}
+}
+
+// Forward listens on localPort, or on a free port if it's 0, and forwards
+// each accepted connection to remotePort on the droplet's localhost
+func (c Connection) Forward(name string, remotePort, localPort int) (*Forward, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if err != nil {
+		return nil, err
+	}
+	forward := &Forward{
+		Droplet:    name,
+		RemotePort: remotePort,
+		LocalPort:  listener.Addr().(*net.TCPAddr).Port,
+		listener:   listener,
+		done:       make(chan struct{}),
+	}
+
+	go func() {
+		for {
+			local, err := listener.Accept()
+			if err != nil {
+				select {
+				case <-forward.done:
+				default:
+					log.Println(fmt.Errorf("failure to accept forwarded connection for %s:%d: %w", name, remotePort, err))
+				}
+				return
+			}
+			go func() {
+				defer local.Close()
+				remote, err := c.client.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", remotePort))
+				if err != nil {
+					log.Println(fmt.Errorf("failure to dial %s:%d: %w", name, remotePort, err))
+					return
+				}
+				defer remote.Close()
+				pipe(local, remote)
+			}()
+		}
+	}()
+
+	return forward, nil
+}
+
+// pipe copies data in both directions until either side is done
+func pipe(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(a, b)
+		a.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(b, a)
+		b.Close()
+	}()
+	wg.Wait()
+}
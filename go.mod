@@ -5,15 +5,28 @@ go 1.15
 require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/digitalocean/godo v1.61.0
+	github.com/ipfs/go-bitswap v0.3.3
+	github.com/ipfs/go-cid v0.0.7
+	github.com/ipfs/go-datastore v0.4.5
+	github.com/ipfs/go-ipfs v0.8.0
 	github.com/ipfs/go-ipfs-config v0.11.0
+	github.com/ipfs/go-ipld-format v0.2.0
+	github.com/ipfs/interface-go-ipfs-core v0.4.0
+	github.com/kevinburke/ssh_config v0.0.0-20190725054713-01f96b0aa0cd
 	github.com/lazyledger/lazyledger-core v0.0.0-20210531043323-6a4b0a7f21a8
 	github.com/lazyledger/nmt v0.5.0
+	github.com/libp2p/go-libp2p-core v0.7.0
+	github.com/libp2p/go-libp2p-record v0.1.3
+	github.com/multiformats/go-multiaddr v0.3.1
+	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.14.0
 	github.com/pulumi/pulumi-digitalocean/sdk/v4 v4.3.1
 	github.com/pulumi/pulumi/sdk/v3 v3.3.1
 	github.com/spf13/cobra v1.1.3
 	github.com/stretchr/testify v1.7.0
 	golang.org/x/crypto v0.0.0-20210513164829-c07d793c2f9a
 	golang.org/x/sys v0.0.0-20210525143221-35b2ab0089ea // indirect
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
 )
 
 replace (
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/digitalocean/godo"
+	"github.com/evan-forbes/devnet/config"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	cloudInitKeysBegin = "-----BEGIN SSH HOST KEY KEYS-----"
+	cloudInitKeysEnd   = "-----END SSH HOST KEY KEYS-----"
+)
+
+func HostKeysCmd() *cobra.Command {
+	hostKeysCmd := &cobra.Command{
+		Use:   "host-keys",
+		Short: "manage the recorded host keys of the droplets",
+	}
+	hostKeysCmd.AddCommand(
+		&cobra.Command{
+			Use:   "import [config-path] [droplet] [console-output-path]",
+			Short: "record the host keys printed by cloud-init in the droplet's console output. Reads from stdin if the path is -",
+			Args:  cobra.MinimumNArgs(3),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				conf, known, err := loadKnownHosts(cmd, args[0])
+				if err != nil {
+					return err
+				}
+				drop, has := conf.Droplets[args[1]]
+				if !has {
+					return fmt.Errorf("droplet not found in config: %s", args[1])
+				}
+
+				var in io.Reader = os.Stdin
+				if args[2] != "-" {
+					file, err := os.Open(args[2])
+					if err != nil {
+						return err
+					}
+					defer file.Close()
+					in = file
+				}
+				keys, err := parseCloudInitKeys(in)
+				if err != nil {
+					return err
+				}
+
+				target, err := dropletTarget(args[1], drop)
+				if err != nil {
+					return err
+				}
+				err = known.Set(target, keys)
+				if err != nil {
+					return err
+				}
+				for _, key := range keys {
+					fmt.Printf("recorded %s host key %s for %s\n", key.Type(), ssh.FingerprintSHA256(key), args[1])
+				}
+				return nil
+			},
+		},
+		&cobra.Command{
+			Use:   "forget [config-path] [droplet]",
+			Short: "remove the recorded host keys of a droplet, ie after it was recreated",
+			Args:  cobra.MinimumNArgs(2),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				conf, known, err := loadKnownHosts(cmd, args[0])
+				if err != nil {
+					return err
+				}
+				drop, has := conf.Droplets[args[1]]
+				if !has {
+					return fmt.Errorf("droplet not found in config: %s", args[1])
+				}
+				target, err := dropletTarget(args[1], drop)
+				if err != nil {
+					return err
+				}
+				return known.Forget(target)
+			},
+		},
+	)
+	return hostKeysCmd
+}
+
+// loadKnownHosts loads the config at path, matches it against the existing
+// digital ocean droplets to get their IDs, and loads its known hosts file
+func loadKnownHosts(cmd *cobra.Command, path string) (config.Config, *KnownHosts, error) {
+	conf, err := config.LoadConfig(path)
+	if err != nil {
+		return conf, nil, err
+	}
+	client := godo.NewFromToken(os.Getenv("DIGITALOCEAN_ACCESS_TOKEN"))
+	conf, err = conf.Match(cmd.Context(), client)
+	if err != nil {
+		return conf, nil, err
+	}
+	known, err := LoadKnownHosts(conf.KnownHostsPath())
+	return conf, known, err
+}
+
+// KnownHost are the host keys recorded for a single droplet
+type KnownHost struct {
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+	// Keys are in the authorized_keys format
+	Keys []string `json:"keys"`
+}
+
+// KnownHosts is a deployment scoped known_hosts file. Droplets are keyed by
+// their ID, and jump hosts that aren't part of the deployment by their
+// address.
+type KnownHosts struct {
+	path  string
+	mut   sync.Mutex
+	Hosts map[string]KnownHost
+}
+
+// LoadKnownHosts loads the known hosts file at path, which doesn't have to
+// exist yet
+func LoadKnownHosts(path string) (*KnownHosts, error) {
+	known := &KnownHosts{
+		path:  path,
+		Hosts: make(map[string]KnownHost),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return known, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &known.Hosts)
+	if err != nil {
+		return nil, fmt.Errorf("failure to parse known hosts file %s: %w", path, err)
+	}
+	return known, nil
+}
+
+// hostTarget identifies a host whose keys are recorded
+type hostTarget struct {
+	// id is the key of the host in the known hosts file
+	id   string
+	name string
+	ip   string
+	// hostKey is the configured host key, if any
+	hostKey string
+}
+
+// dropletTarget identifies a droplet by its ID, as the IPs of destroyed
+// droplets are reused by digital ocean
+func dropletTarget(name string, drop config.Droplet) (hostTarget, error) {
+	if drop.Drop.ID == 0 {
+		return hostTarget{}, fmt.Errorf("droplet %s does not exist", name)
+	}
+	ip, _ := drop.Drop.PublicIPv4()
+	if ip == "" {
+		ip, _ = drop.Drop.PrivateIPv4()
+	}
+	return hostTarget{
+		id:      strconv.Itoa(drop.Drop.ID),
+		name:    name,
+		ip:      ip,
+		hostKey: drop.HostKey,
+	}, nil
+}
+
+// bastionTarget identifies a bastion that is not part of the deployment by
+// its address
+func bastionTarget(b config.Bastion, host, addr string) hostTarget {
+	return hostTarget{
+		id:      "bastion " + addr,
+		name:    "bastion",
+		ip:      host,
+		hostKey: b.HostKey,
+	}
+}
+
+// jumpTarget identifies a ProxyJump host of the ssh config by its address
+func jumpTarget(host, addr string) hostTarget {
+	return hostTarget{
+		id:   "jump " + addr,
+		name: "jump host " + host,
+		ip:   host,
+	}
+}
+
+// Keys returns the expected host keys of the target. A configured host key
+// takes precedence over the recorded ones.
+func (k *KnownHosts) Keys(t hostTarget) ([]ssh.PublicKey, error) {
+	if t.hostKey != "" {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(t.hostKey))
+		if err != nil {
+			return nil, err
+		}
+		return []ssh.PublicKey{key}, nil
+	}
+
+	k.mut.Lock()
+	host, has := k.Hosts[t.id]
+	k.mut.Unlock()
+	if !has {
+		return nil, nil
+	}
+	keys := make([]ssh.PublicKey, 0, len(host.Keys))
+	for _, raw := range host.Keys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(raw))
+		if err != nil {
+			return nil, fmt.Errorf("invalid host key recorded for %s in %s: %w", host.Name, k.path, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Configure sets the host key verification of the ssh client config for the
+// target. The host key must match one of the expected keys. If the target has
+// none, the key presented by the host is accepted, and recorded by the
+// returned function, which must only be called once the connection is
+// authenticated.
+func (k *KnownHosts) Configure(cfg *ssh.ClientConfig, t hostTarget) (func() error, error) {
+	expected, err := k.Keys(t)
+	if err != nil {
+		return nil, err
+	}
+
+	// only negotiate the types of the expected keys, so that the server
+	// doesn't present a key of a different type that can't be verified
+	for _, key := range expected {
+		cfg.HostKeyAlgorithms = append(cfg.HostKeyAlgorithms, key.Type())
+	}
+
+	var (
+		mut  sync.Mutex
+		seen ssh.PublicKey
+	)
+	cfg.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if len(expected) == 0 {
+			mut.Lock()
+			seen = key
+			mut.Unlock()
+			return nil
+		}
+		for _, e := range expected {
+			if bytes.Equal(e.Marshal(), key.Marshal()) {
+				return nil
+			}
+		}
+		return fmt.Errorf(
+			"host key mismatch for %s (id %s, %s): got %s key %s. If the droplet was recreated, run devnet host-keys forget",
+			t.name,
+			t.id,
+			hostname,
+			key.Type(),
+			ssh.FingerprintSHA256(key),
+		)
+	}
+	record := func() error {
+		mut.Lock()
+		defer mut.Unlock()
+		if seen == nil {
+			return nil
+		}
+		return k.Set(t, []ssh.PublicKey{seen})
+	}
+	return record, nil
+}
+
+// Set replaces the recorded host keys of the target and saves the file
+func (k *KnownHosts) Set(t hostTarget, keys []ssh.PublicKey) error {
+	host := KnownHost{Name: t.name, IP: t.ip}
+	for _, key := range keys {
+		host.Keys = append(host.Keys, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))))
+	}
+
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	k.Hosts[t.id] = host
+	return k.save()
+}
+
+// Forget removes the recorded host keys of the target and saves the file
+func (k *KnownHosts) Forget(t hostTarget) error {
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	delete(k.Hosts, t.id)
+	return k.save()
+}
+
+func (k *KnownHosts) save() error {
+	data, err := json.MarshalIndent(k.Hosts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(k.path, data, 0600)
+}
+
+// parseCloudInitKeys parses the host keys that cloud-init prints to the
+// console between the BEGIN and END SSH HOST KEY KEYS markers
+func parseCloudInitKeys(r io.Reader) ([]ssh.PublicKey, error) {
+	var (
+		keys    []ssh.PublicKey
+		inBlock bool
+		scanner = bufio.NewScanner(r)
+	)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.Contains(line, cloudInitKeysBegin):
+			inBlock = true
+		case strings.Contains(line, cloudInitKeysEnd):
+			inBlock = false
+		case inBlock:
+			// console lines can be prefixed, ie by a timestamp, so look
+			// for the start of the key
+			fields := strings.Fields(line)
+			for i := range fields {
+				key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.Join(fields[i:], " ")))
+				if err == nil {
+					keys = append(keys, key)
+					break
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no host keys found in the console output")
+	}
+	return keys, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/evan-forbes/devnet/config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// keyFlag holds the private keys passed using --key, which replace the
+// configured ones
+var keyFlag []string
+
+// defaultKeys are tried in order if no keys are configured, skipping the
+// ones that don't exist
+var defaultKeys = []string{"~/.ssh/id_ed25519", "~/.ssh/id_ecdsa", "~/.ssh/id_rsa"}
+
+// maxAuthKeys is the number of keys offered to a host. Each rejected key
+// counts as a failed attempt, and sshd disconnects after its MaxAuthTries,
+// which defaults to 6. The keys can't be split across several auth methods,
+// as the client doesn't retry a method once it failed.
+const maxAuthKeys = 5
+
+// sshKeys are the candidate keys used to authenticate to the droplets
+type sshKeys struct {
+	signers []ssh.Signer
+	// agent returns the keys of the ssh agent, nil if there is no agent
+	agent func() ([]ssh.Signer, error)
+	// agentConn is the connection to the ssh agent, nil if there is no
+	// agent
+	agentConn  net.Conn
+	passphrase func(path string) string
+
+	mut sync.Mutex
+	// identities caches the keys loaded for specific hosts by path
+	identities map[string]ssh.Signer
+}
+
+// loadSSHKeys loads each candidate private key and connects to the ssh agent
+// listening on SSH_AUTH_SOCK, if any. Candidate keys are the ones passed
+// using --key, or else the configured ssh_keys, or else the default keys.
+// Encrypted keys that weren't passed using --key are skipped with a warning
+// if they can't be decrypted, as the same key is often in the agent.
+func loadSSHKeys(conf config.Config) (*sshKeys, error) {
+	paths, fromFlag := keyFlag, true
+	if len(paths) == 0 {
+		paths, fromFlag = conf.SSHKeys, false
+	}
+	explicit := len(paths) != 0
+	if !explicit {
+		paths = defaultKeys
+	}
+
+	keys := &sshKeys{
+		passphrase: sshPassword,
+		identities: make(map[string]ssh.Signer),
+	}
+	for _, path := range paths {
+		path, err := expandHome(path)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := loadKey(path, keys.passphrase)
+		switch {
+		case os.IsNotExist(err) && !explicit:
+			continue
+		case errors.Is(err, errKeyDecryption) && !fromFlag:
+			fmt.Printf("warning: skipping ssh key %s: %v\n", path, err)
+			continue
+		case err != nil:
+			return nil, fmt.Errorf("failure to load ssh key %s: %w", path, err)
+		}
+		keys.signers = append(keys.signers, signer)
+		// identity files naming the same key don't ask for its
+		// passphrase again
+		keys.identities[path] = signer
+	}
+
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, fmt.Errorf("failure to connect to the ssh agent: %w", err)
+		}
+		// the connection is kept open, as the agent signs each
+		// authentication
+		keys.agentConn = conn
+		keys.agent = agent.NewClient(conn).Signers
+	}
+	return keys, nil
+}
+
+// Close closes the connection to the ssh agent, if any
+func (k *sshKeys) Close() error {
+	if k.agentConn == nil {
+		return nil
+	}
+	return k.agentConn.Close()
+}
+
+// Auth returns an auth method that tries the identity files in order, if any,
+// followed by each candidate key in order and the keys of the ssh agent. Only
+// the first maxAuthKeys distinct keys are tried.
+func (k *sshKeys) Auth(identityFiles []string) (ssh.AuthMethod, error) {
+	signers := make([]ssh.Signer, 0, len(identityFiles)+len(k.signers))
+	for _, path := range identityFiles {
+		identity, err := k.identity(path)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, identity)
+	}
+	signers = append(signers, k.signers...)
+	if len(signers) == 0 && k.agent == nil {
+		return nil, errors.New("no ssh keys found, use --key, ssh_keys or an ssh agent")
+	}
+
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		if k.agent == nil {
+			return limitSigners(signers, maxAuthKeys), nil
+		}
+		fromAgent, err := k.agent()
+		if err != nil {
+			return nil, err
+		}
+		all := append(append([]ssh.Signer{}, signers...), fromAgent...)
+		return limitSigners(all, maxAuthKeys), nil
+	}), nil
+}
+
+// limitSigners returns the first max signers, skipping the ones whose public
+// key was already included, ie a key file that is also in the agent
+func limitSigners(signers []ssh.Signer, max int) []ssh.Signer {
+	var (
+		out  []ssh.Signer
+		seen = make(map[string]struct{})
+	)
+	for _, signer := range signers {
+		if len(out) == max {
+			break
+		}
+		key := string(signer.PublicKey().Marshal())
+		if _, has := seen[key]; has {
+			continue
+		}
+		seen[key] = struct{}{}
+		out = append(out, signer)
+	}
+	return out
+}
+
+// identity loads the key at path, which is only read once
+func (k *sshKeys) identity(path string) (ssh.Signer, error) {
+	path, err := expandHome(path)
+	if err != nil {
+		return nil, err
+	}
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	if signer, has := k.identities[path]; has {
+		return signer, nil
+	}
+	signer, err := loadKey(path, k.passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failure to load ssh key %s: %w", path, err)
+	}
+	k.identities[path] = signer
+	return signer, nil
+}
+
+// errKeyDecryption is returned by loadKey when an encrypted key can't be
+// decrypted with the passphrase given
+var errKeyDecryption = errors.New("failure to decrypt the key")
+
+// loadKey parses the private key at path, which can be in the OpenSSH or the
+// PEM format. The passphrase is only asked for if the key is encrypted.
+func loadKey(path string, passphrase func(path string) string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return signer, err
+	}
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase(path)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errKeyDecryption, err)
+	}
+	return signer, nil
+}
+
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, path[1:]), nil
+}
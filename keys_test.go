@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/evan-forbes/devnet/config"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestLimitSigners(t *testing.T) {
+	signers := make([]ssh.Signer, 4)
+	for i := range signers {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		signers[i], err = ssh.NewSignerFromKey(priv)
+		require.NoError(t, err)
+	}
+	a, b, c, d := signers[0], signers[1], signers[2], signers[3]
+
+	tests := []struct {
+		name    string
+		signers []ssh.Signer
+		max     int
+		want    []ssh.Signer
+	}{
+		{name: "none", signers: nil, max: 5, want: nil},
+		{name: "under the limit", signers: []ssh.Signer{a, b}, max: 5, want: []ssh.Signer{a, b}},
+		{name: "over the limit", signers: []ssh.Signer{a, b, c, d}, max: 3, want: []ssh.Signer{a, b, c}},
+		// a key file that is also in the agent is only offered once
+		{name: "duplicates", signers: []ssh.Signer{a, b, a, c}, max: 3, want: []ssh.Signer{a, b, c}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, limitSigners(tt.signers, tt.max))
+		})
+	}
+}
+
+func TestLoadSSHKeys(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	block, err := x509.EncryptPEMBlock(
+		rand.Reader,
+		"RSA PRIVATE KEY",
+		x509.MarshalPKCS1PrivateKey(priv),
+		[]byte("secret"),
+		x509.PEMCipherAES256,
+	)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "id_rsa")
+	require.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600))
+
+	// the keys of the agent aren't loaded by the test
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	os.Unsetenv("SSH_AUTH_SOCK")
+	defer os.Setenv("SSH_PASS", os.Getenv("SSH_PASS"))
+
+	tests := []struct {
+		name     string
+		fromFlag bool
+		pass     string
+		wantKeys int
+		wantErr  bool
+	}{
+		{name: "configured key", pass: "secret", wantKeys: 1},
+		{name: "flag key", fromFlag: true, pass: "secret", wantKeys: 1},
+		// the key is likely in the agent, which is still tried
+		{name: "undecryptable configured key", pass: "nil", wantKeys: 0},
+		{name: "undecryptable flag key", fromFlag: true, pass: "wrong", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("SSH_PASS", tt.pass)
+			var conf config.Config
+			keyFlag = nil
+			if tt.fromFlag {
+				keyFlag = []string{path}
+			} else {
+				conf.SSHKeys = []string{path}
+			}
+			defer func() { keyFlag = nil }()
+
+			keys, err := loadSSHKeys(conf)
+			if tt.wantErr {
+				require.ErrorIs(t, err, errKeyDecryption)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, keys.signers, tt.wantKeys)
+		})
+	}
+}
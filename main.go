@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
 
 	"github.com/digitalocean/godo"
 	"github.com/evan-forbes/devnet/config"
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 )
 
 func main() {
@@ -18,8 +20,19 @@ func main() {
 		Aliases: []string{"devnet"},
 	}
 
+	rootCmd.PersistentFlags().StringSliceVar(
+		&keyFlag,
+		"key",
+		nil,
+		"private ssh keys tried in order, replacing the configured ssh_keys. Can be repeated",
+	)
+
 	rootCmd.AddCommand(
 		InitCmd(),
+		NetemCmd(),
+		ForwardCmd(),
+		PprofCmd(),
+		HostKeysCmd(),
 	)
 
 	if err := rootCmd.Execute(); err != nil {
@@ -34,47 +47,19 @@ func InitCmd() *cobra.Command {
 		Aliases: []string{"init", "i"},
 		Args:    cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			// get the digital ocean token from the env vars
-			doat := os.Getenv("DIGITALOCEAN_ACCESS_TOKEN")
-
-			// create the digital ocean client
-			client := godo.NewFromToken(doat)
-
-			// load the config from the working dir
-			conf, err := config.LoadConfig(args[0])
-			if err != nil {
-				return err
-			}
-
-			// connect each existing do droplet to the configered ones
-			conf, err = conf.Match(context.TODO(), client)
+			conf, manager, err := connect(cmd.Context(), args[0])
 			if err != nil {
 				return err
 			}
 
-			// fetch the ssh password if any
-			sshPass := os.Getenv("SSH_PASS")
-			switch sshPass {
-			case "nil":
-				sshPass = ""
-			case "":
-				fmt.Println(
-					"password to ssh key (press enter for no password or alternatively export as SSH_PASS). export as 'nil' to ignore future requests",
-				)
-				fmt.Scanf(
-					"%s",
-					&sshPass,
-				)
-			default:
-			}
+			defer manager.CloseAll()
 
-			// establish ssh connections to each droplet
-			manager, err := NewSSHManager(conf.Droplets, sshPass)
+			// create a directory for the artifacts of this run
+			runDir, err := newRunDir(conf)
 			if err != nil {
 				return err
 			}
-
-			defer manager.CloseAll()
+			fmt.Println("run directory:", runDir)
 
 			// save a json representation of the public IPs to each payload dir
 			err = conf.WriteIPsJson()
@@ -103,13 +88,57 @@ func InitCmd() *cobra.Command {
 			}
 			wg.Wait()
 
+			// emulate the configured network conditions now that the
+			// payloads are delivered
+			err = applyNetem(conf, manager)
+			if err != nil {
+				return err
+			}
+
+			// forward the configured ports for the rest of the run
+			tunnels, err := openTunnels(manager, configuredForwards(conf))
+			if err != nil {
+				return err
+			}
+			defer tunnels.Close()
+			if len(tunnels.Forwards) > 0 {
+				err = tunnels.Save(filepath.Join(runDir, "forwards.json"))
+				if err != nil {
+					return err
+				}
+				tunnels.Print()
+			}
+
+			// inject the configured faults, collect metrics and sample the
+			// droplets' resources for as long as the initial commands are
+			// running
+			chaosCtx, stopChaos := context.WithCancel(cmd.Context())
+			var chaosWg sync.WaitGroup
+			report := &Report{}
+			for _, err := range manager.Unreachables() {
+				report.Add("unreachable droplet " + err)
+			}
+			chaosWg.Add(3)
+			go func() {
+				defer chaosWg.Done()
+				runChaos(chaosCtx, conf, manager)
+			}()
+			go func() {
+				defer chaosWg.Done()
+				collectMetrics(chaosCtx, conf, manager, runDir)
+			}()
+			go func() {
+				defer chaosWg.Done()
+				monitorResources(chaosCtx, conf, manager, runDir, report)
+			}()
+
 			// run initial commands and forward their Stdouts and Stderrs to a local file
 			for name, conn := range manager.Conns {
 				wg.Add(1)
 				go func(n string, c Connection) {
 					defer wg.Done()
 					for _, command := range c.drop.InitCommands {
-						err = c.Run(command)
+						err := runCommand(conf, c, command)
 						if err != nil {
 							log.Println(fmt.Errorf("failure to run command %s on %s: %w", command, n, err))
 							continue
@@ -121,7 +150,77 @@ func InitCmd() *cobra.Command {
 			}
 
 			wg.Wait()
-			return nil
+			stopChaos()
+			chaosWg.Wait()
+			return report.Write(runDir)
 		},
 	}
 }
+
+// connect loads the config at path, matches it against the existing digital
+// ocean droplets and establishes an ssh connection to each of them
+func connect(ctx context.Context, path string) (config.Config, *SSHManager, error) {
+	// get the digital ocean token from the env vars
+	doat := os.Getenv("DIGITALOCEAN_ACCESS_TOKEN")
+
+	// create the digital ocean client
+	client := godo.NewFromToken(doat)
+
+	// load the config from the working dir
+	conf, err := config.LoadConfig(path)
+	if err != nil {
+		return conf, nil, err
+	}
+
+	// connect each existing do droplet to the configered ones
+	conf, err = conf.Match(ctx, client)
+	if err != nil {
+		return conf, nil, err
+	}
+
+	// load the host keys recorded on previous connections
+	known, err := LoadKnownHosts(conf.KnownHostsPath())
+	if err != nil {
+		return conf, nil, err
+	}
+
+	// load the ssh keys used to authenticate
+	keys, err := loadSSHKeys(conf)
+	if err != nil {
+		return conf, nil, err
+	}
+
+	// establish ssh connections to each droplet
+	manager, err := NewSSHManager(conf, keys, known)
+	if err != nil {
+		keys.Close()
+		return conf, nil, err
+	}
+
+	return conf, manager, nil
+}
+
+// sshPassword fetches the passphrase of the ssh key at path from the env
+// vars, prompting for it on the terminal if it isn't set
+func sshPassword(path string) string {
+	sshPass := os.Getenv("SSH_PASS")
+	switch sshPass {
+	case "nil":
+		sshPass = ""
+	case "":
+		fd := int(os.Stderr.Fd())
+		if !term.IsTerminal(fd) {
+			return ""
+		}
+		fmt.Fprintf(
+			os.Stderr,
+			"passphrase for ssh key %s (press enter for no passphrase or alternatively export as SSH_PASS, or as 'nil' to ignore future requests): ",
+			path,
+		)
+		pass, _ := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		sshPass = string(pass)
+	default:
+	}
+	return sshPass
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evan-forbes/devnet/config"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// collectMetrics scrapes each droplet's metrics endpoints until ctx is
+// cancelled, appending them to a time series file per endpoint in dir
+func collectMetrics(ctx context.Context, conf config.Config, manager *SSHManager, dir string) {
+	interval, err := conf.MetricsInterval()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	openMetrics := conf.Metrics != nil && conf.Metrics.OpenMetrics
+	if conf.HydraMetrics != nil {
+		log.Println(`hydra_metrics is deprecated, add a "hydra" endpoint to the metrics of the DHT droplets instead`)
+	}
+
+	var wg sync.WaitGroup
+	for name, conn := range manager.Conns {
+		for _, endpoint := range conf.MetricsEndpoints(conn.drop) {
+			wg.Add(1)
+			go func(n string, c Connection, e config.MetricsEndpoint) {
+				defer wg.Done()
+				path := filepath.Join(dir, fmt.Sprintf("metrics-%s-%s", n, e.Name))
+				err := scrapeEndpoint(ctx, n, c, e, interval, path, openMetrics)
+				if err != nil {
+					log.Println(fmt.Errorf("failure to collect %s metrics for %s: %w", e.Name, n, err))
+				}
+			}(name, conn, endpoint)
+		}
+	}
+	wg.Wait()
+}
+
+// scrapeEndpoint writes a line per metric to path.tsv every interval, and each
+// scrape to its own OpenMetrics file in the path-om directory if openMetrics
+// is true, as the metrics of a family can't be split across the scrapes of a
+// single file. Failed scrapes are
+// expected until the server has started, so only changes between failing and
+// succeeding are logged.
+func scrapeEndpoint(
+	ctx context.Context,
+	name string,
+	c Connection,
+	endpoint config.MetricsEndpoint,
+	interval time.Duration,
+	path string,
+	openMetrics bool,
+) error {
+	file, err := os.Create(path + ".tsv")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	defer w.Flush()
+	fmt.Fprintln(w, "timestamp\tmetric\tvalue")
+
+	omDir := path + "-om"
+	if openMetrics {
+		if err := os.MkdirAll(omDir, 0755); err != nil {
+			return err
+		}
+	}
+
+	var (
+		client  = c.httpClient(10 * time.Second)
+		url     = endpoint.URL()
+		failing = true
+		ticker  = time.NewTicker(interval)
+	)
+	defer ticker.Stop()
+	for {
+		families, err := scrapeMetrics(ctx, client, url)
+		switch {
+		case err != nil && !failing:
+			log.Println(fmt.Errorf("failure to scrape %s metrics of %s: %w", endpoint.Name, name, err))
+			failing = true
+		case err == nil:
+			if failing {
+				fmt.Printf("scraping %s metrics of %s\n", endpoint.Name, name)
+				failing = false
+			}
+			now := time.Now()
+			filtered := filterFamilies(families, endpoint.Prefixes)
+			for _, s := range metricSamples(filtered) {
+				fmt.Fprintf(w, "%s\t%s\t%g\n", now.UTC().Format(time.RFC3339Nano), s.name, s.value)
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			if openMetrics {
+				omPath := filepath.Join(omDir, now.UTC().Format("20060102-150405.000")+".om")
+				if err := writeOpenMetrics(omPath, filtered, now); err != nil {
+					return err
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeOpenMetrics writes each family to a new OpenMetrics file at path,
+// timestamping the metrics that don't have a timestamp with now
+func writeOpenMetrics(path string, families []*dto.MetricFamily, now time.Time) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	ms := now.UnixNano() / int64(time.Millisecond)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			if m.TimestampMs == nil {
+				m.TimestampMs = &ms
+			}
+		}
+		if _, err := expfmt.MetricFamilyToOpenMetrics(w, family); err != nil {
+			return err
+		}
+	}
+	if _, err := expfmt.FinalizeOpenMetrics(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// httpClient returns an http client whose connections are tunneled through
+// the ssh connection, so that servers only listening on the droplet's
+// localhost can be reached
+func (c Connection) httpClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return c.client.Dial(network, addr)
+			},
+		},
+	}
+}
+
+// scrapeMetrics fetches and parses the prometheus metrics served at url
+func scrapeMetrics(ctx context.Context, client *http.Client, url string) (map[string]*dto.MetricFamily, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	var parser expfmt.TextParser
+	return parser.TextToMetricFamilies(resp.Body)
+}
+
+type metricSample struct {
+	name  string
+	value float64
+}
+
+// filterFamilies returns the metric families whose name starts with one of
+// the prefixes, sorted by name. Every family is returned if there are no
+// prefixes.
+func filterFamilies(families map[string]*dto.MetricFamily, prefixes []string) []*dto.MetricFamily {
+	filtered := make([]*dto.MetricFamily, 0, len(families))
+	for name, family := range families {
+		if len(prefixes) == 0 || hasAnyPrefix(name, prefixes) {
+			filtered = append(filtered, family)
+		}
+	}
+	sort.Slice(filtered, func(i, j int) bool { return filtered[i].GetName() < filtered[j].GetName() })
+	return filtered
+}
+
+// metricSamples flattens each metric family into samples named after the
+// metric and its labels. Summaries and histograms are reduced to their sum
+// and count.
+func metricSamples(families []*dto.MetricFamily) []metricSample {
+	var samples []metricSample
+	for _, family := range families {
+		name := family.GetName()
+		for _, m := range family.GetMetric() {
+			labels := metricLabels(m.GetLabel())
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				samples = append(samples, metricSample{name + labels, m.GetCounter().GetValue()})
+			case dto.MetricType_GAUGE:
+				samples = append(samples, metricSample{name + labels, m.GetGauge().GetValue()})
+			case dto.MetricType_UNTYPED:
+				samples = append(samples, metricSample{name + labels, m.GetUntyped().GetValue()})
+			case dto.MetricType_SUMMARY:
+				samples = append(
+					samples,
+					metricSample{name + "_sum" + labels, m.GetSummary().GetSampleSum()},
+					metricSample{name + "_count" + labels, float64(m.GetSummary().GetSampleCount())},
+				)
+			case dto.MetricType_HISTOGRAM:
+				samples = append(
+					samples,
+					metricSample{name + "_sum" + labels, m.GetHistogram().GetSampleSum()},
+					metricSample{name + "_count" + labels, float64(m.GetHistogram().GetSampleCount())},
+				)
+			}
+		}
+	}
+	return samples
+}
+
+// metricLabels formats labels the same way prometheus does, ie {a="b",c="d"}
+func metricLabels(pairs []*dto.LabelPair) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	labels := make([]string, len(pairs))
+	for i, p := range pairs {
+		labels[i] = fmt.Sprintf("%s=%q", p.GetName(), p.GetValue())
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/require"
+)
+
+const testScrape = `# HELP hydrabooster_connected_peers Peers connected.
+# TYPE hydrabooster_connected_peers gauge
+hydrabooster_connected_peers{head="0"} 12
+hydrabooster_connected_peers{head="1"} 8
+# HELP hydrabooster_provider_records_total Provider records stored.
+# TYPE hydrabooster_provider_records_total counter
+hydrabooster_provider_records_total 42
+# HELP hydrabooster_lookup_seconds Lookup latency.
+# TYPE hydrabooster_lookup_seconds histogram
+hydrabooster_lookup_seconds_bucket{le="0.5"} 3
+hydrabooster_lookup_seconds_bucket{le="+Inf"} 5
+hydrabooster_lookup_seconds_sum 4.2
+hydrabooster_lookup_seconds_count 5
+`
+
+// parseOpenMetrics checks that data is a single OpenMetrics exposition, and
+// returns the type of each family and the timestamp of each sample
+func parseOpenMetrics(t *testing.T, data string) (map[string]string, []float64) {
+	require.True(t, strings.HasSuffix(data, "# EOF\n"), "missing # EOF")
+	lines := strings.Split(strings.TrimSuffix(data, "# EOF\n"), "\n")
+	lines = lines[:len(lines)-1]
+
+	var (
+		types      = make(map[string]string)
+		seen       = make(map[string]bool)
+		current    string
+		timestamps []float64
+	)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		switch {
+		case line == "# EOF":
+			t.Fatal("# EOF before the end")
+		case strings.HasPrefix(line, "# "):
+			// the metadata of a family comes before its samples, and the
+			// families aren't interleaved
+			if fields[2] != current {
+				require.False(t, seen[fields[2]], "family %s split", fields[2])
+				seen[fields[2]] = true
+				current = fields[2]
+			}
+			if fields[1] == "TYPE" {
+				_, has := types[current]
+				require.False(t, has, "second TYPE for %s", current)
+				types[current] = fields[3]
+			}
+		default:
+			// samples are name{labels} value timestamp
+			require.Len(t, fields, 3, "sample without a timestamp: %s", line)
+			require.NotEmpty(t, current, "sample before any TYPE")
+			require.True(t, strings.HasPrefix(fields[0], current), "sample %s outside of family %s", fields[0], current)
+			_, err := strconv.ParseFloat(fields[1], 64)
+			require.NoError(t, err)
+			ts, err := strconv.ParseFloat(fields[2], 64)
+			require.NoError(t, err)
+			timestamps = append(timestamps, ts)
+		}
+	}
+	return types, timestamps
+}
+
+func TestWriteOpenMetrics(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Unix(1600000000, 0)
+	for scrape := 0; scrape < 2; scrape++ {
+		var parser expfmt.TextParser
+		families, err := parser.TextToMetricFamilies(strings.NewReader(testScrape))
+		require.NoError(t, err)
+
+		now := start.Add(time.Duration(scrape) * 15 * time.Second)
+		path := filepath.Join(dir, now.UTC().Format("20060102-150405.000")+".om")
+		require.NoError(t, writeOpenMetrics(path, filterFamilies(families, nil), now))
+
+		data, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		types, timestamps := parseOpenMetrics(t, string(data))
+		require.Equal(t, map[string]string{
+			"hydrabooster_connected_peers":  "gauge",
+			"hydrabooster_provider_records": "counter",
+			"hydrabooster_lookup_seconds":   "histogram",
+		}, types)
+		require.Len(t, timestamps, 7)
+		for _, ts := range timestamps {
+			require.Equal(t, float64(now.Unix()), ts)
+		}
+	}
+}
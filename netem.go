@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/evan-forbes/devnet/config"
+	"github.com/spf13/cobra"
+)
+
+const defaultNetemInterface = "eth0"
+
+func NetemCmd() *cobra.Command {
+	netemCmd := &cobra.Command{
+		Use:   "netem",
+		Short: "emulate network conditions on the droplets using tc netem",
+	}
+	netemCmd.AddCommand(
+		&cobra.Command{
+			Use:   "apply [config-path]",
+			Short: "apply the netem conditions described in the config",
+			Args:  cobra.MinimumNArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				conf, manager, err := connect(cmd.Context(), args[0])
+				if err != nil {
+					return err
+				}
+				defer manager.CloseAll()
+
+				return applyNetem(conf, manager)
+			},
+		},
+		&cobra.Command{
+			Use:   "clear [config-path]",
+			Short: "remove any netem conditions from each droplet",
+			Args:  cobra.MinimumNArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				conf, manager, err := connect(cmd.Context(), args[0])
+				if err != nil {
+					return err
+				}
+				defer manager.CloseAll()
+
+				return forEachConn(manager, func(n string, c Connection) error {
+					return c.ClearNetem(netemInterface(conf))
+				})
+			},
+		},
+	)
+	return netemCmd
+}
+
+// applyNetem shapes the traffic of each droplet that has netem conditions
+// configured
+func applyNetem(conf config.Config, manager *SSHManager) error {
+	ips, err := conf.IPs()
+	if err != nil {
+		return err
+	}
+	return forEachConn(manager, func(n string, c Connection) error {
+		if c.drop.Netem == nil && len(c.drop.Links) == 0 {
+			return nil
+		}
+		err := c.ApplyNetem(netemInterface(conf), ips)
+		if err != nil {
+			return err
+		}
+		fmt.Println("applied netem for:", n)
+		return nil
+	})
+}
+
+// forEachConn concurrently calls fn for each connection, logging any failures
+// and returning the last one
+func forEachConn(manager *SSHManager, fn func(name string, c Connection) error) error {
+	var (
+		wg      sync.WaitGroup
+		mut     sync.Mutex
+		lastErr error
+	)
+	for name, conn := range manager.Conns {
+		wg.Add(1)
+		go func(n string, c Connection) {
+			defer wg.Done()
+			err := fn(n, c)
+			if err != nil {
+				log.Println(fmt.Errorf("%s: %w", n, err))
+				mut.Lock()
+				lastErr = err
+				mut.Unlock()
+			}
+		}(name, conn)
+	}
+	wg.Wait()
+	return lastErr
+}
+
+func netemInterface(conf config.Config) string {
+	if conf.NetemInterface == "" {
+		return defaultNetemInterface
+	}
+	return conf.NetemInterface
+}
+
+// ApplyNetem replaces the root qdisc of iface with an htb qdisc that sends all
+// traffic through the droplet's netem conditions, and the traffic to each
+// linked droplet through that link's conditions
+func (c Connection) ApplyNetem(iface string, ips map[string]string) error {
+	commands, err := netemCommands(iface, c.drop, ips)
+	if err != nil {
+		return err
+	}
+	for _, command := range commands {
+		err := c.RunPrivileged(command)
+		if err != nil {
+			return fmt.Errorf("failure to run command %s: %w", command, err)
+		}
+	}
+	return nil
+}
+
+// ClearNetem removes the root qdisc of iface, and with it any netem conditions
+func (c Connection) ClearNetem(iface string) error {
+	return c.RunPrivileged(fmt.Sprintf("tc qdisc del dev %s root 2>/dev/null || true", iface))
+}
+
+func netemCommands(iface string, drop config.Droplet, ips map[string]string) ([]string, error) {
+	commands := []string{
+		fmt.Sprintf("tc qdisc del dev %s root 2>/dev/null || true", iface),
+		fmt.Sprintf("tc qdisc add dev %s root handle 1: htb default 1", iface),
+		fmt.Sprintf("tc class add dev %s parent 1: classid 1:1 htb rate 10gbit", iface),
+	}
+	if drop.Netem != nil {
+		commands = append(
+			commands,
+			fmt.Sprintf("tc qdisc add dev %s parent 1:1 handle 10: netem %s", iface, drop.Netem.Args()),
+		)
+	}
+
+	// sort the links so that the class ids are stable between runs
+	links := make([]string, 0, len(drop.Links))
+	for peer := range drop.Links {
+		links = append(links, peer)
+	}
+	sort.Strings(links)
+
+	for i, peer := range links {
+		ip, has := ips[peer]
+		if !has {
+			return nil, fmt.Errorf("no public IP found for linked droplet %s", peer)
+		}
+		class := i + 2
+		commands = append(
+			commands,
+			fmt.Sprintf("tc class add dev %s parent 1: classid 1:%x htb rate 10gbit", iface, class),
+			fmt.Sprintf("tc qdisc add dev %s parent 1:%x handle %x: netem %s", iface, class, class*16, drop.Links[peer].Args()),
+			fmt.Sprintf("tc filter add dev %s protocol ip parent 1: prio 1 u32 match ip dst %s/32 flowid 1:%x", iface, ip, class),
+		)
+	}
+	return commands, nil
+}
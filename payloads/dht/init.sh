@@ -1,4 +1,4 @@
 #!/bin/bash
 
 # start the hydra-booster node and begin serving the http api
-/root/dht/hydra-booster -httpapi-addr "0.0.0.0:7779"
\ No newline at end of file
+$HOME/dht/hydra-booster -httpapi-addr "0.0.0.0:7779"
\ No newline at end of file
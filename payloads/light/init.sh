@@ -4,13 +4,13 @@
 sleep 25
 
 # export the public ips of the other nodes
-source /root/light/public_ipv4s.sh
+source $HOME/light/public_ipv4s.sh
 
 # init ipfs
-/root/light/das init
+$HOME/light/das init
 
 # install the hydra-booster node as a bootstrap node
-/root/light/das add-hydra "$dht1sgp1":7779 /root/ipfs/config
+$HOME/light/das add-hydra --wait 2m "$dht1sgp1":7779 $HOME/ipfs/config
 
 # get the *latest* data availability header and use it to sample via IPFS. Do this 10 times
-/root/light/das sample "$validator1nyc3":26657 10
\ No newline at end of file
+$HOME/light/das sample --pprof-addr 127.0.0.1:6061 "$validator1nyc3":26657 10
\ No newline at end of file
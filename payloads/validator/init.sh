@@ -1,10 +1,7 @@
 #!bin/bash
 
-# wait for the hydra node to start
-sleep 10
-
 # export the public ips of the other nodes
-source /root/validator/public_ipv4s.sh
+source $HOME/validator/public_ipv4s.sh
 
-# add the hydra-booster node as bootstrap dht node
-/root/validator/das add-hydra "$dht1sgp1":7779 /root/.tendermint/ipfs/config
\ No newline at end of file
+# add the hydra-booster node as bootstrap dht node, waiting for it to start
+$HOME/validator/das add-hydra --wait 2m "$dht1sgp1":7779 $HOME/.tendermint/ipfs/config
\ No newline at end of file
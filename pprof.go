@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// pprofAddresses are the addresses the pprof servers of each target listen on
+// by default
+var pprofAddresses = map[string]string{
+	// das is started with --pprof-addr 127.0.0.1:6061 by the light payload
+	"das": "127.0.0.1:6061",
+	// tendermint's pprof-laddr in config.toml, set by the example init commands
+	"tendermint": "127.0.0.1:6060",
+	// hydra serves pprof alongside its prometheus metrics
+	"hydra": "127.0.0.1:9758",
+}
+
+func PprofCmd() *cobra.Command {
+	var (
+		target  string
+		addr    string
+		seconds int
+	)
+	cmd := &cobra.Command{
+		Use:     "pprof [config-path] [droplet]",
+		Aliases: []string{"pprof", "p"},
+		Short:   "capture a cpu and a heap profile of a process running on a droplet",
+		Args:    cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if addr == "" {
+				addr = pprofAddresses[target]
+			}
+			if addr == "" {
+				return fmt.Errorf("unknown pprof target %s, expected one of %s or --addr", target, pprofTargets())
+			}
+
+			conf, manager, err := connect(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			defer manager.CloseAll()
+
+			name := args[1]
+			conn, has := manager.Conns[name]
+			if !has {
+				return fmt.Errorf("no connection to droplet %s", name)
+			}
+
+			runDir, err := latestRunDir(conf)
+			if err != nil {
+				return err
+			}
+
+			prefix := filepath.Join(
+				runDir,
+				fmt.Sprintf("pprof-%s-%s-%s", name, target, time.Now().UTC().Format("20060102-150405")),
+			)
+			return conn.CaptureProfiles(cmd.Context(), addr, seconds, prefix)
+		},
+	}
+	cmd.Flags().StringVar(
+		&target,
+		"target",
+		"das",
+		fmt.Sprintf("process to profile, one of %s", pprofTargets()),
+	)
+	cmd.Flags().StringVar(
+		&addr,
+		"addr",
+		"",
+		"address of the pprof server on the droplet, overriding the target's default",
+	)
+	cmd.Flags().IntVar(&seconds, "seconds", 30, "duration of the cpu profile")
+	return cmd
+}
+
+func pprofTargets() string {
+	targets := make([]string, 0, len(pprofAddresses))
+	for target := range pprofAddresses {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return strings.Join(targets, "|")
+}
+
+// CaptureProfiles fetches a cpu profile lasting seconds and a heap profile
+// from the pprof server at addr on the droplet, saving them to
+// prefix-cpu.pb.gz and prefix-heap.pb.gz
+func (c Connection) CaptureProfiles(ctx context.Context, addr string, seconds int, prefix string) error {
+	// leave enough time for the cpu profile to be recorded and transferred
+	client := c.httpClient(time.Duration(seconds)*time.Second + time.Minute)
+
+	profiles := []struct {
+		url, path string
+	}{
+		{fmt.Sprintf("http://%s/debug/pprof/profile?seconds=%d", addr, seconds), prefix + "-cpu.pb.gz"},
+		{fmt.Sprintf("http://%s/debug/pprof/heap", addr), prefix + "-heap.pb.gz"},
+	}
+	for _, p := range profiles {
+		fmt.Println("fetching", p.url)
+		err := fetchToFile(ctx, client, p.url, p.path)
+		if err != nil {
+			return fmt.Errorf("failure to fetch %s: %w", p.url, err)
+		}
+		fmt.Println("saved", p.path)
+	}
+	return nil
+}
+
+func fetchToFile(ctx context.Context, client *http.Client, url, path string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, resp.Body)
+	return err
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshClient is an ssh connection that is monitored using keepalive requests,
+// and redialed with an exponential backoff when it dies. Sessions and tunnels
+// always use the current connection.
+type sshClient struct {
+	name string
+	dial func() (*ssh.Client, error)
+	// keepAlive is the interval between two keepalive requests, which are
+	// not sent if it is 0
+	keepAlive  time.Duration
+	countMax   int
+	maxBackoff time.Duration
+
+	mut     sync.Mutex
+	client  *ssh.Client
+	closing chan struct{}
+	once    sync.Once
+}
+
+// newSSHClient dials the host, and keeps it connected until it is closed
+func newSSHClient(
+	name string,
+	dial func() (*ssh.Client, error),
+	keepAlive time.Duration,
+	countMax int,
+	maxBackoff time.Duration,
+) (*sshClient, error) {
+	client, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	c := &sshClient{
+		name:       name,
+		dial:       dial,
+		keepAlive:  keepAlive,
+		countMax:   countMax,
+		maxBackoff: maxBackoff,
+		client:     client,
+		closing:    make(chan struct{}),
+	}
+	go c.monitor(client)
+	return c, nil
+}
+
+// Client returns the current connection, which might be dead while it is
+// being re-established
+func (c *sshClient) Client() *ssh.Client {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.client
+}
+
+func (c *sshClient) Dial(network, addr string) (net.Conn, error) {
+	return c.Client().Dial(network, addr)
+}
+
+func (c *sshClient) NewSession() (*ssh.Session, error) {
+	return c.Client().NewSession()
+}
+
+// Closed reports whether the client was closed, in which case it is not
+// reconnected anymore
+func (c *sshClient) Closed() bool {
+	select {
+	case <-c.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the current connection and stops reconnecting
+func (c *sshClient) Close() error {
+	c.once.Do(func() { close(c.closing) })
+	return c.Client().Close()
+}
+
+// monitor reconnects each time the connection dies, until the client is
+// closed
+func (c *sshClient) monitor(client *ssh.Client) {
+	for {
+		c.watch(client)
+		if c.Closed() {
+			return
+		}
+		log.Printf("lost ssh connection to %s, reconnecting\n", c.name)
+		client = c.reconnect()
+		if client == nil {
+			return
+		}
+		log.Printf("reconnected to %s\n", c.name)
+	}
+}
+
+// watch returns once the connection is closed, either by the network or
+// because countMax keepalive requests in a row weren't replied to
+func (c *sshClient) watch(client *ssh.Client) {
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(done)
+	}()
+	if c.keepAlive <= 0 {
+		<-done
+		return
+	}
+
+	ticker := time.NewTicker(c.keepAlive)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			// a request that isn't replied to before the next one is due
+			// counts as missed
+			err := sendKeepAlive(client, c.keepAlive)
+			switch {
+			case err == nil:
+				missed = 0
+				continue
+			case errors.Is(err, errNoKeepAliveReply):
+				missed++
+				if missed < c.countMax {
+					continue
+				}
+				err = fmt.Errorf("no reply to %d keepalive requests in a row", missed)
+			}
+			if !c.Closed() {
+				log.Println(fmt.Errorf("ssh connection to %s is dead: %w", c.name, err))
+			}
+			client.Close()
+			<-done
+			return
+		}
+	}
+}
+
+// reconnect dials the host until it succeeds, doubling the wait between two
+// attempts up to maxBackoff. It returns nil if the client is closed first.
+func (c *sshClient) reconnect() *ssh.Client {
+	backoff := time.Second
+	for {
+		client, err := c.dial()
+		if err == nil {
+			c.mut.Lock()
+			defer c.mut.Unlock()
+			if c.Closed() {
+				client.Close()
+				return nil
+			}
+			c.client = client
+			return client
+		}
+		log.Println(fmt.Errorf("failure to reconnect to %s, retrying in %s: %w", c.name, backoff, err))
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-c.closing:
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+		backoff *= 2
+		if backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+}
+
+var errNoKeepAliveReply = errors.New("no reply to keepalive request")
+
+// sendKeepAlive sends a keepalive request, failing with errNoKeepAliveReply if
+// it isn't replied to within timeout. Servers reply to it with a failure,
+// which still proves that the connection is alive.
+func sendKeepAlive(client *ssh.Client, timeout time.Duration) error {
+	replied := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		replied <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-replied:
+		return err
+	case <-timer.C:
+		return errNoKeepAliveReply
+	}
+}
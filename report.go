@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Report collects the warnings raised during a run so that they can be
+// reviewed once it is over
+type Report struct {
+	mut      sync.Mutex
+	warnings []string
+}
+
+// Warn prints a warning and adds it to the report
+func (r *Report) Warn(format string, a ...interface{}) {
+	warning := fmt.Sprintf(format, a...)
+	fmt.Println("warning:", warning)
+	r.Add(warning)
+}
+
+// Add adds a warning to the report without printing it, ie because it was
+// already logged
+func (r *Report) Add(warning string) {
+	r.mut.Lock()
+	r.warnings = append(r.warnings, warning)
+	r.mut.Unlock()
+}
+
+// Write writes each warning to report.txt in dir
+func (r *Report) Write(dir string) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	var b strings.Builder
+	if len(r.warnings) == 0 {
+		b.WriteString("no warnings\n")
+	}
+	for _, w := range r.warnings {
+		fmt.Fprintf(&b, "warning: %s\n", w)
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "report.txt"), []byte(b.String()), 0644)
+}
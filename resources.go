@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evan-forbes/devnet/config"
+)
+
+// resourcesCommand prints the kernel's cpu, memory and network counters,
+// separated so that each file can be parsed on its own
+const resourcesCommand = "cat /proc/stat; echo ---; cat /proc/meminfo; echo ---; cat /proc/net/dev"
+
+// resourceCounters are the raw counters read from a droplet's /proc
+type resourceCounters struct {
+	time time.Time
+	// cpuTotal and cpuIdle are in USER_HZ summed over every cpu
+	cpuTotal, cpuIdle uint64
+	// memTotal and memAvailable are in bytes
+	memTotal, memAvailable uint64
+	// rxBytes and txBytes are summed over every interface but loopback
+	rxBytes, txBytes uint64
+}
+
+// resourceSample is the usage of a droplet's resources between two reads of
+// its counters
+type resourceSample struct {
+	// cpu and memory are in percent
+	cpu, memory              float64
+	memoryUsed               uint64
+	rxBytesPerS, txBytesPerS float64
+}
+
+// resourceStats summarizes the samples of a single droplet
+type resourceStats struct {
+	samples, cpuSaturated, memSaturated int
+	maxCPU, maxMemory                   float64
+}
+
+// monitorResources samples the resource usage of each droplet until ctx is
+// cancelled, appending it to a time series file per droplet in dir. A
+// warning is added to the report for each droplet that was saturated.
+func monitorResources(ctx context.Context, conf config.Config, manager *SSHManager, dir string, report *Report) {
+	if conf.Resources != nil && conf.Resources.Disabled {
+		return
+	}
+	interval, err := conf.Resources.IntervalDuration()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	cpuLimit, memLimit := conf.Resources.Saturation()
+
+	var wg sync.WaitGroup
+	for name, conn := range manager.Conns {
+		wg.Add(1)
+		go func(n string, c Connection) {
+			defer wg.Done()
+			path := filepath.Join(dir, fmt.Sprintf("resources-%s.tsv", n))
+			stats, err := sampleResources(ctx, n, c, interval, cpuLimit, memLimit, path)
+			if err != nil {
+				log.Println(fmt.Errorf("failure to sample the resources of %s: %w", n, err))
+			}
+			if stats.cpuSaturated > 0 {
+				report.Warn(
+					"%s was cpu saturated (>= %.0f%%) in %d of %d samples, max %.1f%%",
+					n, cpuLimit, stats.cpuSaturated, stats.samples, stats.maxCPU,
+				)
+			}
+			if stats.memSaturated > 0 {
+				report.Warn(
+					"%s was memory saturated (>= %.0f%%) in %d of %d samples, max %.1f%%",
+					n, memLimit, stats.memSaturated, stats.samples, stats.maxMemory,
+				)
+			}
+		}(name, conn)
+	}
+	wg.Wait()
+}
+
+// sampleResources writes the resource usage of the droplet to path every
+// interval
+func sampleResources(
+	ctx context.Context,
+	name string,
+	c Connection,
+	interval time.Duration,
+	cpuLimit, memLimit float64,
+	path string,
+) (resourceStats, error) {
+	var stats resourceStats
+
+	file, err := os.Create(path)
+	if err != nil {
+		return stats, err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	defer w.Flush()
+	fmt.Fprintln(w, "timestamp\tcpu_pct\tmem_pct\tmem_used_bytes\trx_bytes_per_s\ttx_bytes_per_s")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var prev *resourceCounters
+	for {
+		// a failed read only skips a sample, as the droplet might be
+		// temporarily overloaded
+		counters, err := readResources(c)
+		if err != nil {
+			log.Println(fmt.Errorf("failure to read the resources of %s: %w", name, err))
+		}
+
+		// usage is measured between two reads, so the first read is only
+		// used as a reference
+		if err == nil && prev != nil {
+			s := counters.since(*prev)
+			stats.samples++
+			if s.cpu >= cpuLimit {
+				stats.cpuSaturated++
+			}
+			if s.memory >= memLimit {
+				stats.memSaturated++
+			}
+			if s.cpu > stats.maxCPU {
+				stats.maxCPU = s.cpu
+			}
+			if s.memory > stats.maxMemory {
+				stats.maxMemory = s.memory
+			}
+			fmt.Fprintf(
+				w,
+				"%s\t%.2f\t%.2f\t%d\t%.0f\t%.0f\n",
+				counters.time.UTC().Format(time.RFC3339Nano),
+				s.cpu,
+				s.memory,
+				s.memoryUsed,
+				s.rxBytesPerS,
+				s.txBytesPerS,
+			)
+			if err := w.Flush(); err != nil {
+				return stats, err
+			}
+		}
+		if err == nil {
+			prev = &counters
+		}
+
+		select {
+		case <-ctx.Done():
+			return stats, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// readResources reads the droplet's resource counters
+func readResources(c Connection) (resourceCounters, error) {
+	out, err := c.Output(resourcesCommand)
+	if err != nil {
+		return resourceCounters{}, err
+	}
+	return parseResources(out)
+}
+
+// since returns the resource usage between prev and c
+func (c resourceCounters) since(prev resourceCounters) resourceSample {
+	var s resourceSample
+	total, idle := counterDelta(c.cpuTotal, prev.cpuTotal), counterDelta(c.cpuIdle, prev.cpuIdle)
+	if total > 0 && idle <= total {
+		s.cpu = 100 * float64(total-idle) / float64(total)
+	}
+	if c.memTotal > 0 {
+		s.memoryUsed = c.memTotal - c.memAvailable
+		s.memory = 100 * float64(s.memoryUsed) / float64(c.memTotal)
+	}
+	if elapsed := c.time.Sub(prev.time).Seconds(); elapsed > 0 {
+		s.rxBytesPerS = float64(counterDelta(c.rxBytes, prev.rxBytes)) / elapsed
+		s.txBytesPerS = float64(counterDelta(c.txBytes, prev.txBytes)) / elapsed
+	}
+	return s
+}
+
+// counterDelta returns the increase of a counter from prev to cur. A counter
+// that decreased was reset, ie by a reboot or an interface going down, and
+// counted up from 0 to cur since.
+func counterDelta(cur, prev uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+// parseResources parses the output of resourcesCommand
+func parseResources(out []byte) (resourceCounters, error) {
+	counters := resourceCounters{time: time.Now()}
+	parts := strings.Split(string(out), "---\n")
+	if len(parts) != 3 {
+		return counters, errors.New("unexpected output of the resources command")
+	}
+
+	// the first line of /proc/stat sums the time of every cpu:
+	// cpu user nice system idle iowait irq softirq steal guest guest_nice
+	// guest time is already included in user time
+	for _, line := range strings.Split(parts[0], "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 9 || fields[0] != "cpu" {
+			continue
+		}
+		for i, field := range fields[1:9] {
+			v, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return counters, fmt.Errorf("invalid /proc/stat line %q: %w", line, err)
+			}
+			counters.cpuTotal += v
+			// idle and iowait
+			if i == 3 || i == 4 {
+				counters.cpuIdle += v
+			}
+		}
+		break
+	}
+
+	for _, line := range strings.Split(parts[1], "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			counters.memTotal = v * 1024
+		case "MemAvailable:":
+			counters.memAvailable = v * 1024
+		}
+	}
+
+	// each interface line of /proc/net/dev is "iface: rx_bytes ... tx_bytes
+	// ...", with the transmit counters starting at the 9th field
+	for _, line := range strings.Split(parts[2], "\n") {
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			continue
+		}
+		iface := strings.TrimSpace(line[:colon])
+		fields := strings.Fields(line[colon+1:])
+		if iface == "lo" || len(fields) < 9 {
+			continue
+		}
+		rx, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		tx, err := strconv.ParseUint(fields[8], 10, 64)
+		if err != nil {
+			continue
+		}
+		counters.rxBytes += rx
+		counters.txBytes += tx
+	}
+
+	return counters, nil
+}
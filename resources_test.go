@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testProcStat = `cpu  100 10 50 800 40 0 5 0 0 0
+cpu0 50 5 25 400 20 0 2 0 0 0
+intr 12345
+`
+	testMeminfo = `MemTotal:        2000 kB
+MemFree:          500 kB
+MemAvailable:    1500 kB
+`
+	testNetDev = `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo: 9999       10    0    0    0     0          0         0     9999      10    0    0    0     0       0          0
+  eth0: 1000       10    0    0    0     0          0         0     2000      20    0    0    0     0       0          0
+  eth1:  300        3    0    0    0     0          0         0      400       4    0    0    0     0       0          0
+`
+)
+
+func TestParseResources(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    resourceCounters
+		wantErr bool
+	}{
+		{
+			name: "all counters",
+			out:  testProcStat + "---\n" + testMeminfo + "---\n" + testNetDev,
+			want: resourceCounters{
+				cpuTotal:     1005,
+				cpuIdle:      840,
+				memTotal:     2000 * 1024,
+				memAvailable: 1500 * 1024,
+				// the loopback interface is skipped
+				rxBytes: 1300,
+				txBytes: 2400,
+			},
+		},
+		{
+			name: "empty files",
+			out:  "---\n---\n",
+			want: resourceCounters{},
+		},
+		{
+			name: "no memavailable",
+			out:  testProcStat + "---\nMemTotal: 2000 kB\n---\n",
+			want: resourceCounters{cpuTotal: 1005, cpuIdle: 840, memTotal: 2000 * 1024},
+		},
+		{
+			name:    "invalid cpu counter",
+			out:     "cpu 1 2 x 4 5 6 7 8\n---\n---\n",
+			wantErr: true,
+		},
+		{
+			name:    "missing separator",
+			out:     testProcStat + "---\n" + testMeminfo,
+			wantErr: true,
+		},
+		{
+			name:    "empty output",
+			out:     "",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseResources([]byte(tt.out))
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.WithinDuration(t, time.Now(), got.time, time.Minute)
+			got.time = time.Time{}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestResourceSince(t *testing.T) {
+	start := time.Now()
+	prev := resourceCounters{
+		time:     start,
+		cpuTotal: 1000,
+		cpuIdle:  800,
+		rxBytes:  5000,
+		txBytes:  8000,
+	}
+	tests := []struct {
+		name string
+		cur  resourceCounters
+		want resourceSample
+	}{
+		{
+			name: "increase",
+			cur: resourceCounters{
+				time:         start.Add(2 * time.Second),
+				cpuTotal:     1200,
+				cpuIdle:      850,
+				memTotal:     2000,
+				memAvailable: 500,
+				rxBytes:      7000,
+				txBytes:      9000,
+			},
+			want: resourceSample{cpu: 75, memory: 75, memoryUsed: 1500, rxBytesPerS: 1000, txBytesPerS: 500},
+		},
+		{
+			// the droplet rebooted, so the counters restarted from 0
+			name: "reset",
+			cur: resourceCounters{
+				time:     start.Add(2 * time.Second),
+				cpuTotal: 100,
+				cpuIdle:  50,
+				rxBytes:  400,
+				txBytes:  200,
+			},
+			want: resourceSample{cpu: 50, rxBytesPerS: 200, txBytesPerS: 100},
+		},
+		{
+			// only the interface counters were reset
+			name: "interface reset",
+			cur: resourceCounters{
+				time:     start.Add(time.Second),
+				cpuTotal: 1100,
+				cpuIdle:  900,
+				rxBytes:  100,
+				txBytes:  8100,
+			},
+			want: resourceSample{cpu: 0, rxBytesPerS: 100, txBytesPerS: 100},
+		},
+		{
+			name: "no elapsed time",
+			cur:  resourceCounters{time: start, cpuTotal: 1000, cpuIdle: 800, rxBytes: 5000, txBytes: 8000},
+			want: resourceSample{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, tt.cur.since(prev))
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/evan-forbes/devnet/config"
+)
+
+const defaultRunDir = "runs"
+
+// newRunDir creates a timestamped directory for the artifacts of a single run
+func newRunDir(conf config.Config) (string, error) {
+	path := filepath.Join(runRoot(conf), time.Now().UTC().Format("20060102-150405"))
+	return path, os.MkdirAll(path, 0755)
+}
+
+// latestRunDir returns the most recent run directory, creating a new one if
+// there is none, so that the artifacts of commands run alongside init are
+// stored with the rest of the run
+func latestRunDir(conf config.Config) (string, error) {
+	root := runRoot(conf)
+	entries, err := ioutil.ReadDir(root)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	// the timestamped names sort chronologically
+	latest := ""
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() > latest {
+			latest = entry.Name()
+		}
+	}
+	if latest == "" {
+		return newRunDir(conf)
+	}
+	return filepath.Join(root, latest), nil
+}
+
+// runRoot returns the directory containing every run directory
+func runRoot(conf config.Config) string {
+	if conf.RunDir == "" {
+		return defaultRunDir
+	}
+	return conf.RunDir
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Upload recursively copies the local file or directory at src into the
+// remote directory dst using the scp protocol, so that no external scp binary
+// with its own host key handling is needed
+func (c Connection) Upload(src, dst string) error {
+	sesh, err := c.NewSession()
+	if err != nil {
+		return err
+	}
+	defer sesh.Close()
+
+	stdin, err := sesh.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := sesh.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	sesh.Stderr = &stderr
+
+	err = sesh.Start(fmt.Sprintf("scp -r -t '%s'", strings.ReplaceAll(dst, "'", "")))
+	if err != nil {
+		return err
+	}
+
+	acks := bufio.NewReader(stdout)
+	// the remote scp acknowledges that it's ready before anything is sent
+	err = scpAck(acks)
+	if err == nil {
+		err = scpSend(stdin, acks, src)
+	}
+	stdin.Close()
+	waitErr := sesh.Wait()
+	if err != nil {
+		return err
+	}
+	if waitErr != nil {
+		return fmt.Errorf("%w: %s", waitErr, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// scpSend sends the file or directory at path, waiting for the remote scp to
+// acknowledge each message
+func scpSend(w io.Writer, acks *bufio.Reader, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(path)
+
+	if !info.IsDir() {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = fmt.Fprintf(w, "C%04o %d %s\n", info.Mode().Perm(), info.Size(), name)
+		if err != nil {
+			return err
+		}
+		if err := scpAck(acks); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		_, err = io.CopyN(w, file, info.Size())
+		if err != nil {
+			return err
+		}
+		// a null byte marks the end of the file's content
+		_, err = w.Write([]byte{0})
+		if err != nil {
+			return err
+		}
+		return scpAck(acks)
+	}
+
+	_, err = fmt.Fprintf(w, "D%04o 0 %s\n", info.Mode().Perm(), name)
+	if err != nil {
+		return err
+	}
+	if err := scpAck(acks); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err := scpSend(w, acks, filepath.Join(path, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprint(w, "E\n")
+	if err != nil {
+		return err
+	}
+	return scpAck(acks)
+}
+
+// scpAck reads the response of the remote scp, which is a null byte on
+// success, or a 1 (warning) or 2 (error) followed by a message
+func scpAck(acks *bufio.Reader) error {
+	code, err := acks.ReadByte()
+	if err != nil {
+		return err
+	}
+	if code == 0 {
+		return nil
+	}
+	msg, err := acks.ReadString('\n')
+	if err != nil && msg == "" {
+		return fmt.Errorf("scp error code %d", code)
+	}
+	return errors.New(strings.TrimSpace(msg))
+}
@@ -1,15 +1,15 @@
 package main
 
 import (
-	"crypto/x509"
-	"encoding/pem"
-	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
 	"os"
-	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/evan-forbes/devnet/config"
 	"golang.org/x/crypto/ssh"
@@ -17,95 +17,483 @@ import (
 
 type SSHManager struct {
 	Conns map[string]Connection
+	// jumps are the jump hosts that aren't droplets
+	jumps *jumpHosts
+	// keys are closed along with the connections, which use them to
+	// reconnect
+	keys *sshKeys
+	// bastion is the name of the droplet used as the bastion, if any
+	bastion string
+	// Unreachable are the droplets that couldn't be connected to when
+	// skip_unreachable is set, along with the reason
+	Unreachable map[string]error
 }
 
-func NewSSHManager(drops map[string]config.Droplet, sshPass string) (*SSHManager, error) {
-	conns := make(map[string]Connection)
-	for name, drop := range drops {
-		conn, err := NewConnection(drop, sshPass)
-		if err != nil {
-			return nil, err
+// NewSSHManager connects to the droplets concurrently, going through the
+// bastion for the droplets that don't have a public IPv4. Unless
+// skip_unreachable is set, every established connection is closed if any of
+// the droplets can't be connected to. Once connected, the manager owns keys,
+// which are closed by CloseAll.
+func NewSSHManager(conf config.Config, keys *sshKeys, known *KnownHosts) (*SSHManager, error) {
+	sshConfig, err := loadSSHConfig(conf.SSHConfig)
+	if err != nil {
+		return nil, err
+	}
+	maxBackoff, err := conf.KeepAlive.MaxBackoffDuration()
+	if err != nil {
+		return nil, err
+	}
+	c := &connector{
+		conf:       conf,
+		keys:       keys,
+		known:      known,
+		sshConfig:  sshConfig,
+		maxBackoff: maxBackoff,
+		jumpDials:  make(map[string]*jumpDial),
+	}
+	manager := &SSHManager{
+		Conns:       make(map[string]Connection),
+		jumps:       &jumpHosts{clients: make(map[string]*sshClient)},
+		Unreachable: make(map[string]error),
+	}
+
+	var bastion *sshClient
+	if b := conf.Bastion; b != nil {
+		if b.Droplet != "" {
+			conn, err := c.connect(b.Droplet, conf.Droplets[b.Droplet], nil, manager.jumps)
+			if err != nil {
+				manager.CloseAll()
+				return nil, fmt.Errorf("failure to connect to bastion %s: %w", b.Droplet, err)
+			}
+			manager.Conns[b.Droplet] = conn
+			manager.bastion = b.Droplet
+			bastion = conn.client
+		} else {
+			bastion, err = c.dialBastion(manager.jumps)
+			if err != nil {
+				manager.CloseAll()
+				return nil, fmt.Errorf("failure to connect to bastion %s: %w", b.Host, err)
+			}
 		}
-		conns[name] = conn
 	}
-	return &SSHManager{
-		Conns: conns,
-	}, nil
+
+	var (
+		wg     sync.WaitGroup
+		mut    sync.Mutex
+		failed bool
+		limit  = make(chan struct{}, conf.ConnectLimit())
+	)
+	for name, drop := range conf.Droplets {
+		if name == manager.bastion {
+			continue
+		}
+		wg.Add(1)
+		go func(name string, drop config.Droplet) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+
+			// don't bother connecting once the manager is bound to fail
+			mut.Lock()
+			skip := failed && !conf.SkipUnreachable
+			mut.Unlock()
+			if skip {
+				return
+			}
+
+			conn, err := c.connect(name, drop, bastion, manager.jumps)
+			mut.Lock()
+			defer mut.Unlock()
+			if err != nil {
+				manager.Unreachable[name] = err
+				failed = true
+				return
+			}
+			manager.Conns[name] = conn
+		}(name, drop)
+	}
+	wg.Wait()
+
+	if failed && !conf.SkipUnreachable {
+		errs := manager.Unreachables()
+		manager.CloseAll()
+		return nil, fmt.Errorf("failure to connect to %s", strings.Join(errs, ", "))
+	}
+	for _, err := range manager.Unreachables() {
+		log.Println("continuing without unreachable droplet", err)
+	}
+	manager.keys = keys
+	return manager, nil
 }
 
-// CloseAll closes each established ssh session
+// Unreachables describes why each unreachable droplet couldn't be connected
+// to, sorted by name
+func (s *SSHManager) Unreachables() []string {
+	names := make([]string, 0, len(s.Unreachable))
+	for name := range s.Unreachable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	errs := make([]string, 0, len(names))
+	for _, name := range names {
+		errs = append(errs, fmt.Sprintf("%s: %v", name, s.Unreachable[name]))
+	}
+	return errs
+}
+
+// CloseAll closes each established ssh session, and then the connection to
+// the ssh agent. Jump hosts are closed last, as the other sessions are
+// tunneled through them.
 func (s *SSHManager) CloseAll() {
 	for name, c := range s.Conns {
-		err := c.Close()
+		if name == s.bastion {
+			continue
+		}
+		s.closeConn(name, c)
+	}
+	if c, has := s.Conns[s.bastion]; has {
+		s.closeConn(s.bastion, c)
+	}
+
+	s.jumps.closeAll()
+
+	if s.keys != nil {
+		err := s.keys.Close()
 		if err != nil {
-			log.Println(
-				fmt.Errorf(
-					"failure to close ssh session for %s: %w", name, err,
-				),
-			)
+			log.Println(fmt.Errorf("failure to close the connection to the ssh agent: %w", err))
 		}
 	}
 }
 
+// jumpHosts are the clients of the jump hosts that aren't droplets, keyed by
+// their address, or their chain for ProxyJump hosts
+type jumpHosts struct {
+	mut     sync.Mutex
+	clients map[string]*sshClient
+	// order is the order in which the hosts were connected to
+	order []string
+}
+
+func (j *jumpHosts) add(key string, client *sshClient) {
+	j.mut.Lock()
+	defer j.mut.Unlock()
+	j.clients[key] = client
+	j.order = append(j.order, key)
+}
+
+// closeAll closes the hosts in the reverse order they were connected to, so
+// that each host is closed before the ones it is tunneled through
+func (j *jumpHosts) closeAll() {
+	j.mut.Lock()
+	defer j.mut.Unlock()
+	for i := len(j.order) - 1; i >= 0; i-- {
+		key := j.order[i]
+		err := j.clients[key].Close()
+		if err != nil {
+			log.Println(fmt.Errorf("failure to close ssh session for jump host %s: %w", key, err))
+		}
+	}
+}
+
+func (s *SSHManager) closeConn(name string, c Connection) {
+	err := c.Close()
+	if err != nil {
+		log.Println(
+			fmt.Errorf(
+				"failure to close ssh session for %s: %w", name, err,
+			),
+		)
+	}
+}
+
 type Connection struct {
-	client *ssh.Client
+	client *sshClient
 	drop   config.Droplet
+	// user is the user logged in as on the droplet
+	user   string
 	output *os.File
 }
 
-func NewConnection(drop config.Droplet, sshPass string) (Connection, error) {
-	home, err := os.UserHomeDir()
+// connector holds everything needed to connect to the droplets
+type connector struct {
+	conf  config.Config
+	keys  *sshKeys
+	known *KnownHosts
+	// sshConfig is the user's ssh config, nil if it isn't used
+	sshConfig  *sshConfigFile
+	maxBackoff time.Duration
+	// jumpMut guards the dials of the ProxyJump hosts, which are shared by
+	// the droplets being connected to concurrently, keyed by their chain
+	jumpMut   sync.Mutex
+	jumpDials map[string]*jumpDial
+}
+
+// jumpDial is a connection to a ProxyJump host that the droplets sharing it
+// wait for, so that it is only dialed once
+type jumpDial struct {
+	done   chan struct{}
+	client *sshClient
+	err    error
+}
+
+// connect connects to the droplet, verifying its host key against the known
+// hosts. Droplets without a public IPv4 are connected to through the bastion,
+// and the others through their ProxyJump from the ssh config, if any. Jump
+// hosts are reused from jumps, and added to it when first connected to. The
+// connection is re-established if it dies.
+func (c *connector) connect(
+	name string,
+	drop config.Droplet,
+	bastion *sshClient,
+	jumps *jumpHosts,
+) (Connection, error) {
+	host, viaBastion, err := c.conf.SSHAddress(drop)
 	if err != nil {
 		return Connection{}, err
 	}
+	if viaBastion && bastion == nil {
+		return Connection{}, fmt.Errorf("droplet %s has no public IPv4 to connect to", name)
+	}
 
-	host, err := drop.Drop.PublicIPv4()
+	// the devnet config takes precedence over the matching Host blocks of
+	// the ssh config
+	settings, err := c.sshConfig.settings(name, host)
 	if err != nil {
 		return Connection{}, err
 	}
+	user := c.conf.SSHUserFor(drop)
+	if drop.SSHUser == "" && c.conf.SSHUser == "" && settings.User != "" {
+		user = settings.User
+	}
+	port := c.conf.SSHPortFor(drop)
+	if drop.SSHPort == 0 && c.conf.SSHPort == 0 && settings.Port != 0 {
+		port = settings.Port
+	}
+
+	var jump *sshClient
+	switch {
+	case viaBastion:
+		jump = bastion
+	case settings.ProxyJump != "":
+		jump, err = c.proxyJump(settings.ProxyJump, jumps)
+		if err != nil {
+			return Connection{}, fmt.Errorf("failure to connect to jump host %s: %w", settings.ProxyJump, err)
+		}
+	}
 
-	sshConfig, err := newSshClientConfig("root", host, 22, home+"/.ssh/id_rsa", sshPass)
+	files, err := identityFiles(settings.IdentityFiles, name, host, port, user)
+	if err != nil {
+		return Connection{}, err
+	}
+	auth, err := c.keys.Auth(files)
+	if err != nil {
+		return Connection{}, err
+	}
+	target, err := dropletTarget(name, drop)
 	if err != nil {
 		return Connection{}, err
 	}
 
 	// connect to the server via ssh
-	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", host, 22), sshConfig)
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	client, err := c.newClient(name, settings.ServerAliveInterval, func() (*ssh.Client, error) {
+		return c.dial(jump, addr, newSshClientConfig(user, auth), target)
+	})
 	if err != nil {
 		return Connection{}, err
 	}
 
 	output, err := os.OpenFile(drop.Output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0700)
 	if err != nil {
+		client.Close()
 		return Connection{}, err
 	}
 
 	return Connection{
 		client: client,
 		drop:   drop,
+		user:   user,
 		output: output,
 	}, nil
 }
 
-func (c Connection) DeliverPayload() error {
-	ipv4, err := c.drop.Drop.PublicIPv4()
+// dialBastion connects to the configured bastion host that isn't one of the
+// droplets, adding it to jumps
+func (c *connector) dialBastion(jumps *jumpHosts) (*sshClient, error) {
+	host, addr, err := c.conf.Bastion.Address(c.conf.SSHPortFor(config.Droplet{}))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	auth, err := c.keys.Auth(nil)
+	if err != nil {
+		return nil, err
+	}
+	target := bastionTarget(*c.conf.Bastion, host, addr)
+	client, err := c.newClient("bastion "+addr, 0, func() (*ssh.Client, error) {
+		return c.dial(nil, addr, newSshClientConfig(c.conf.BastionUser(), auth), target)
+	})
+	if err != nil {
+		return nil, err
+	}
+	jumps.add(addr, client)
+	return client, nil
+}
+
+// proxyJump connects through each hop of an ssh config ProxyJump, ie
+// "user@jump1:22,jump2", returning the client of the last hop. Each hop is
+// dialed once, while the droplets that share it wait for that dial.
+func (c *connector) proxyJump(spec string, jumps *jumpHosts) (*sshClient, error) {
+	var (
+		jump  *sshClient
+		chain string
+	)
+	for _, hop := range strings.Split(spec, ",") {
+		chain += "," + hop
+
+		c.jumpMut.Lock()
+		dial, dialing := c.jumpDials[chain]
+		if !dialing {
+			dial = &jumpDial{done: make(chan struct{})}
+			c.jumpDials[chain] = dial
+		}
+		c.jumpMut.Unlock()
+
+		if !dialing {
+			dial.client, dial.err = c.dialHop(hop, jump)
+			if dial.err == nil {
+				jumps.add(chain, dial.client)
+			}
+			close(dial.done)
+		}
+		<-dial.done
+		if dial.err != nil {
+			return nil, dial.err
+		}
+		jump = dial.client
+	}
+	return jump, nil
+}
+
+// dialHop connects to a hop of a ProxyJump through prev, resolving it using
+// its own Host blocks of the ssh config
+func (c *connector) dialHop(hop string, prev *sshClient) (*sshClient, error) {
+	user, alias, port := parseHop(strings.TrimSpace(hop))
+	settings, err := c.sshConfig.settings(alias)
+	if err != nil {
+		return nil, err
+	}
+	host := alias
+	if settings.HostName != "" {
+		host = settings.HostName
+	}
+	if user == "" {
+		user = settings.User
+	}
+	if user == "" {
+		user = c.conf.SSHUserFor(config.Droplet{})
 	}
+	if port == "" && settings.Port != 0 {
+		port = strconv.Itoa(settings.Port)
+	}
+	if port == "" {
+		port = "22"
+	}
+
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in ProxyJump hop %s: %w", hop, err)
+	}
+	files, err := identityFiles(settings.IdentityFiles, alias, host, portNum, user)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := c.keys.Auth(files)
+	if err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(host, port)
+	target := jumpTarget(host, addr)
+	return c.newClient("jump host "+addr, settings.ServerAliveInterval, func() (*ssh.Client, error) {
+		return c.dial(prev, addr, newSshClientConfig(user, auth), target)
+	})
+}
+
+// parseHop splits a ProxyJump hop of the form [user@]host[:port]
+func parseHop(hop string) (user, host, port string) {
+	if at := strings.LastIndex(hop, "@"); at >= 0 {
+		user, hop = hop[:at], hop[at+1:]
+	}
+	host, port, err := net.SplitHostPort(hop)
+	if err != nil {
+		return user, hop, ""
+	}
+	return user, host, port
+}
 
-	cmd := exec.Command(
-		"scp",
-		"-r",
-		"-o StrictHostKeyChecking=no",
-		"-o UserKnownHostsFile=/dev/null",
-		c.drop.Payload,
-		fmt.Sprintf("root@%s:/root/", ipv4),
+// newClient dials the host and keeps it connected, sending keepalive
+// requests at the configured interval, or else at the ServerAliveInterval of
+// the ssh config
+func (c *connector) newClient(
+	name string,
+	sshConfigInterval time.Duration,
+	dial func() (*ssh.Client, error),
+) (*sshClient, error) {
+	return newSSHClient(
+		name,
+		dial,
+		c.conf.KeepAliveInterval(sshConfigInterval),
+		c.conf.KeepAlive.Count(),
+		c.maxBackoff,
 	)
-	err = cmd.Run()
+}
+
+// dial connects to the ssh server at addr, verifying its host key against the
+// known hosts. A new host key is only recorded once the connection is
+// authenticated, so that a failed login doesn't pin the key of whatever
+// answered.
+func (c *connector) dial(jump *sshClient, addr string, sshConfig *ssh.ClientConfig, target hostTarget) (*ssh.Client, error) {
+	record, err := c.known.Configure(sshConfig, target)
 	if err != nil {
-		return fmt.Errorf("failure to execute command: %w", err)
+		return nil, err
 	}
+	client, err := dialSSH(jump, addr, sshConfig)
+	if err != nil {
+		return nil, err
+	}
+	err = record()
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failure to record host key of %s: %w", target.name, err)
+	}
+	return client, nil
+}
 
+// dialSSH connects to the ssh server at addr, tunneling the connection
+// through the current connection of jump if it isn't nil
+func dialSSH(jump *sshClient, addr string, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	if jump == nil {
+		return ssh.Dial("tcp", addr, sshConfig)
+	}
+	conn, err := jump.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// DeliverPayload copies the droplet's payload directory to the ssh user's home
+// directory over the verified ssh connection
+func (c Connection) DeliverPayload() error {
+	// the remote scp resolves relative paths from the home directory
+	err := c.Upload(c.drop.Payload, ".")
+	if err != nil {
+		return fmt.Errorf("failure to deliver payload %s: %w", c.drop.Payload, err)
+	}
 	return nil
 }
 
@@ -124,109 +512,54 @@ func (c Connection) Run(command string) error {
 	return sesh.Run(command)
 }
 
-func (c Connection) NewSession() (*ssh.Session, error) {
-	return c.client.NewSession()
-}
-
-func (c Connection) Close() error {
-	err := c.client.Close()
-	if err != nil {
-		return err
+// RunPrivileged runs a command that needs root, ie tc or iptables, using sudo
+// if the ssh user isn't root. sudo must not ask for a password.
+func (c Connection) RunPrivileged(command string) error {
+	if c.user != "root" {
+		command = "sudo -n sh -c " + shellQuote(command)
 	}
-	return c.output.Close()
+	return c.Run(command)
 }
 
-func newSshClientConfig(user string, host string, port int, privateKeyPath string, privateKeyPassword string) (*ssh.ClientConfig, error) {
-	// read private key file
-	pemBytes, err := ioutil.ReadFile(privateKeyPath)
-	if err != nil {
-		return nil, fmt.Errorf("Reading private key file failed %v", err)
-	}
-	// create signer
-	signer, err := signerFromPem(pemBytes, []byte(privateKeyPassword))
+// Output runs a command on the ssh server and returns its Stdout
+func (c Connection) Output(command string) ([]byte, error) {
+	sesh, err := c.NewSession()
 	if err != nil {
 		return nil, err
 	}
-	// build SSH client config
-	config := &ssh.ClientConfig{
-		User: user,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			// use OpenSSH's known_hosts file if you care about host validation
-			return nil
-		},
-	}
+	defer sesh.Close()
 
-	return config, nil
+	return sesh.Output(command)
 }
 
-func signerFromPem(pemBytes []byte, password []byte) (ssh.Signer, error) {
-	// read pem block
-	err := errors.New("Pem decode failed, no key found")
-	pemBlock, _ := pem.Decode(pemBytes)
-	if pemBlock == nil {
-		return nil, err
-	}
-
-	// handle encrypted key
-	if x509.IsEncryptedPEMBlock(pemBlock) {
-		// decrypt PEM
-		pemBlock.Bytes, err = x509.DecryptPEMBlock(pemBlock, []byte(password))
-		if err != nil {
-			return nil, fmt.Errorf("Decrypting PEM block failed %v", err)
-		}
-
-		// get RSA, EC or DSA key
-		key, err := parsePemBlock(pemBlock)
-		if err != nil {
-			return nil, err
-		}
-
-		// generate signer instance from key
-		signer, err := ssh.NewSignerFromKey(key)
-		if err != nil {
-			return nil, fmt.Errorf("Creating signer from encrypted key failed %v", err)
-		}
+// Event records a timestamped event in the local client's output file so that
+// it can be correlated with the rest of the droplet's output
+func (c Connection) Event(format string, a ...interface{}) error {
+	_, err := fmt.Fprintf(
+		c.output,
+		"#EVENT %s %s\n",
+		time.Now().UTC().Format(time.RFC3339Nano),
+		fmt.Sprintf(format, a...),
+	)
+	return err
+}
 
-		return signer, nil
-	} else {
-		// generate signer instance from plain key
-		signer, err := ssh.ParsePrivateKey(pemBytes)
-		if err != nil {
-			return nil, fmt.Errorf("Parsing plain private key failed %v", err)
-		}
+func (c Connection) NewSession() (*ssh.Session, error) {
+	return c.client.NewSession()
+}
 
-		return signer, nil
+func (c Connection) Close() error {
+	err := c.client.Close()
+	if err != nil {
+		return err
 	}
+	return c.output.Close()
 }
 
-func parsePemBlock(block *pem.Block) (interface{}, error) {
-	switch block.Type {
-	case "RSA PRIVATE KEY":
-		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
-		if err != nil {
-			return nil, fmt.Errorf("Parsing PKCS private key failed %v", err)
-		} else {
-			return key, nil
-		}
-	case "EC PRIVATE KEY":
-		key, err := x509.ParseECPrivateKey(block.Bytes)
-		if err != nil {
-			return nil, fmt.Errorf("Parsing EC private key failed %v", err)
-		} else {
-			return key, nil
-		}
-	case "DSA PRIVATE KEY":
-		key, err := ssh.ParseDSAPrivateKey(block.Bytes)
-		if err != nil {
-			return nil, fmt.Errorf("Parsing DSA private key failed %v", err)
-		} else {
-			return key, nil
-		}
-	default:
-		return nil, fmt.Errorf("Parsing private key failed, unsupported key type %q", block.Type)
+func newSshClientConfig(user string, auth ssh.AuthMethod) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{auth},
 	}
 }
 
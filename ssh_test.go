@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHop(t *testing.T) {
+	tests := []struct {
+		hop                          string
+		wantUser, wantHost, wantPort string
+	}{
+		{hop: "jump", wantHost: "jump"},
+		{hop: "alice@jump", wantUser: "alice", wantHost: "jump"},
+		{hop: "jump:2222", wantHost: "jump", wantPort: "2222"},
+		{hop: "alice@jump:2222", wantUser: "alice", wantHost: "jump", wantPort: "2222"},
+		{hop: "203.0.113.7:22", wantHost: "203.0.113.7", wantPort: "22"},
+		{hop: "[2001:db8::1]:22", wantHost: "2001:db8::1", wantPort: "22"},
+		// an IPv6 address without a port can't be told apart from one with
+		// a port, so it is kept as is
+		{hop: "2001:db8::1", wantHost: "2001:db8::1"},
+		// only the last @ separates the user
+		{hop: "a@b@jump", wantUser: "a@b", wantHost: "jump"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hop, func(t *testing.T) {
+			user, host, port := parseHop(tt.hop)
+			require.Equal(t, tt.wantUser, user)
+			require.Equal(t, tt.wantHost, host)
+			require.Equal(t, tt.wantPort, port)
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kevinburke/ssh_config"
+)
+
+// hostSettings are the settings of the matching Host blocks of an ssh config
+type hostSettings struct {
+	HostName string
+	User     string
+	Port     int
+	// IdentityFiles can contain the tokens expanded by expandTokens
+	IdentityFiles       []string
+	ProxyJump           string
+	ServerAliveInterval time.Duration
+}
+
+// sshConfigFile is an OpenSSH client config, ie ~/.ssh/config
+type sshConfigFile struct {
+	cfg *ssh_config.Config
+}
+
+// loadSSHConfig parses the ssh config at path, returning nil if path is empty
+func loadSSHConfig(path string) (*sshConfigFile, error) {
+	if path == "" {
+		return nil, nil
+	}
+	path, err := expandHome(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	cfg, err := ssh_config.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("failure to parse ssh config %s: %w", path, err)
+	}
+	return &sshConfigFile{cfg: cfg}, nil
+}
+
+// settings returns the settings of the Host blocks matching any of the
+// aliases, ie the droplet's name and IP. Earlier aliases take precedence, and
+// the zero value is returned if f is nil.
+func (f *sshConfigFile) settings(aliases ...string) (hostSettings, error) {
+	var s hostSettings
+	if f == nil {
+		return s, nil
+	}
+
+	get := func(key string) (string, error) {
+		for _, alias := range aliases {
+			v, err := f.get(alias, key)
+			if err != nil || v != "" {
+				return v, err
+			}
+		}
+		return "", nil
+	}
+
+	var err error
+	if s.HostName, err = get("HostName"); err != nil {
+		return s, err
+	}
+	if s.User, err = get("User"); err != nil {
+		return s, err
+	}
+	for _, alias := range aliases {
+		if s.IdentityFiles, err = f.getAll(alias, "IdentityFile"); err != nil || len(s.IdentityFiles) > 0 {
+			break
+		}
+	}
+	if err != nil {
+		return s, err
+	}
+	if s.ProxyJump, err = get("ProxyJump"); err != nil {
+		return s, err
+	}
+	if strings.EqualFold(s.ProxyJump, "none") {
+		s.ProxyJump = ""
+	}
+
+	port, err := get("Port")
+	if err != nil {
+		return s, err
+	}
+	if port != "" {
+		if s.Port, err = strconv.Atoi(port); err != nil {
+			return s, fmt.Errorf("invalid Port %q in ssh config: %w", port, err)
+		}
+	}
+
+	interval, err := get("ServerAliveInterval")
+	if err != nil {
+		return s, err
+	}
+	if interval != "" {
+		seconds, err := strconv.Atoi(interval)
+		if err != nil {
+			return s, fmt.Errorf("invalid ServerAliveInterval %q in ssh config: %w", interval, err)
+		}
+		s.ServerAliveInterval = time.Duration(seconds) * time.Second
+	}
+	return s, nil
+}
+
+// get returns the first value of key in the Host blocks matching alias. The
+// parser panics on Match blocks, which are not supported.
+func (f *sshConfigFile) get(alias, key string) (v string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("unsupported ssh config: %v", r)
+		}
+	}()
+	return f.cfg.Get(alias, key)
+}
+
+// getAll returns every value of key in the Host blocks matching alias, in
+// order. Only the first value of an Include directive is returned, as the
+// parser doesn't expose the others.
+func (f *sshConfigFile) getAll(alias, key string) (vs []string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("unsupported ssh config: %v", r)
+		}
+	}()
+	for _, host := range f.cfg.Hosts {
+		if !host.Matches(alias) {
+			continue
+		}
+		for _, node := range host.Nodes {
+			switch t := node.(type) {
+			case *ssh_config.KV:
+				switch {
+				case strings.EqualFold(t.Key, "match"):
+					return nil, fmt.Errorf("unsupported ssh config: Match directive")
+				case strings.EqualFold(t.Key, key):
+					vs = append(vs, t.Value)
+				}
+			case *ssh_config.Include:
+				if v := t.Get(alias, key); v != "" {
+					vs = append(vs, v)
+				}
+			}
+		}
+	}
+	return vs, nil
+}
+
+// identityFiles expands the tokens and the leading ~ of the identity files of
+// a host, which is connected to as remoteUser on host:port using the alias
+func identityFiles(paths []string, alias, host string, port int, remoteUser string) ([]string, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	tokens, err := localTokens()
+	if err != nil {
+		return nil, err
+	}
+	tokens['n'] = alias
+	tokens['h'] = host
+	tokens['p'] = strconv.Itoa(port)
+	tokens['r'] = remoteUser
+
+	files := make([]string, 0, len(paths))
+	for _, path := range paths {
+		file, err := expandTokens(path, tokens)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IdentityFile %q in ssh config: %w", path, err)
+		}
+		file, err = expandHome(file)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// localTokens are the values of the ssh config tokens that describe the local
+// host: %d is the home directory, %u the user and %l the hostname
+func localTokens() (map[byte]string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	local, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return map[byte]string{'d': home, 'u': local.Username, 'l': hostname}, nil
+}
+
+// expandTokens replaces the %x tokens of an ssh config value with their value
+// in tokens, and %% with %
+func expandTokens(s string, tokens map[byte]string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", fmt.Errorf("trailing %% in %q", s)
+		}
+		if s[i] == '%' {
+			b.WriteByte('%')
+			continue
+		}
+		v, has := tokens[s[i]]
+		if !has {
+			return "", fmt.Errorf("unsupported token %%%c in %q", s[i], s)
+		}
+		b.WriteString(v)
+	}
+	return b.String(), nil
+}
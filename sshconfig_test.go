@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kevinburke/ssh_config"
+	"github.com/stretchr/testify/require"
+)
+
+const testSSHConfig = `
+Host val1
+    HostName 203.0.113.1
+    User alice
+    Port 2222
+    IdentityFile ~/.ssh/val1
+    IdentityFile ~/.ssh/%r@%h
+
+Host 203.0.113.*
+    User bob
+    ProxyJump jump1,jump2
+    ServerAliveInterval 10
+
+Host direct
+    ProxyJump none
+
+Host badport
+    Port twenty
+
+Host badinterval
+    ServerAliveInterval 10s
+`
+
+func TestSSHConfigSettings(t *testing.T) {
+	cfg, err := ssh_config.Decode(strings.NewReader(testSSHConfig))
+	require.NoError(t, err)
+	file := &sshConfigFile{cfg: cfg}
+
+	tests := []struct {
+		name    string
+		aliases []string
+		want    hostSettings
+		wantErr bool
+	}{
+		{
+			name:    "name only",
+			aliases: []string{"val1"},
+			want: hostSettings{
+				HostName:      "203.0.113.1",
+				User:          "alice",
+				Port:          2222,
+				IdentityFiles: []string{"~/.ssh/val1", "~/.ssh/%r@%h"},
+			},
+		},
+		{
+			name:    "ip only",
+			aliases: []string{"unknown", "203.0.113.9"},
+			want: hostSettings{
+				User:                "bob",
+				ProxyJump:           "jump1,jump2",
+				ServerAliveInterval: 10 * time.Second,
+			},
+		},
+		{
+			// earlier aliases take precedence, and the others fill in
+			// the missing settings
+			name:    "name and ip",
+			aliases: []string{"val1", "203.0.113.1"},
+			want: hostSettings{
+				HostName:            "203.0.113.1",
+				User:                "alice",
+				Port:                2222,
+				IdentityFiles:       []string{"~/.ssh/val1", "~/.ssh/%r@%h"},
+				ProxyJump:           "jump1,jump2",
+				ServerAliveInterval: 10 * time.Second,
+			},
+		},
+		{name: "proxy jump none", aliases: []string{"direct"}, want: hostSettings{}},
+		{name: "no match", aliases: []string{"other"}, want: hostSettings{}},
+		{name: "invalid port", aliases: []string{"badport"}, wantErr: true},
+		{name: "invalid interval", aliases: []string{"badinterval"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := file.settings(tt.aliases...)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestSSHConfigSettingsNil(t *testing.T) {
+	var file *sshConfigFile
+	got, err := file.settings("val1")
+	require.NoError(t, err)
+	require.Equal(t, hostSettings{}, got)
+}
+
+func TestExpandTokens(t *testing.T) {
+	tokens := map[byte]string{'d': "/home/alice", 'h': "203.0.113.1", 'r': "root"}
+	tests := []struct {
+		name    string
+		s       string
+		want    string
+		wantErr bool
+	}{
+		{name: "no tokens", s: "~/.ssh/id_ed25519", want: "~/.ssh/id_ed25519"},
+		{name: "tokens", s: "%d/.ssh/%r@%h", want: "/home/alice/.ssh/root@203.0.113.1"},
+		{name: "escaped percent", s: "%d/100%%", want: "/home/alice/100%"},
+		{name: "unsupported token", s: "%C", wantErr: true},
+		{name: "trailing percent", s: "key%", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandTokens(tt.s, tokens)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}